@@ -0,0 +1,187 @@
+package knockrd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AllowFileTemplates are builtin templates for allow files.
+var AllowFileTemplates = map[string]string{
+	"nginx":     "{{ range . }}allow {{ .CIDR }};\n{{ end }}",
+	"nginx-geo": "{{ range . }}{{ .CIDR }} 1;\n{{ end }}",
+	"haproxy":   "{{ range . }}{{ .CIDR }}\n{{ end }}",
+	"apache":    "{{ range . }}Require ip {{ .CIDR }}\n{{ end }}",
+}
+
+// AllowFileEntry represents an allowed address passed to templates of allow files.
+type AllowFileEntry struct {
+	Address  string // a network in CIDR notation for a widened allowance
+	CIDR     string
+	Identity string
+	Expires  time.Time
+}
+
+type allowFileWriter struct {
+	conf     *AllowFileConfig
+	tmpl     *template.Template
+	executor commandExecutor
+	dryRun   bool
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newAllowFileWriter(c *AllowFileConfig, executor commandExecutor) (*allowFileWriter, error) {
+	text := c.Template
+	if text == "" {
+		var ok bool
+		if text, ok = AllowFileTemplates[c.Format]; !ok {
+			return nil, fmt.Errorf("invalid format %s for %s", c.Format, c.Path)
+		}
+	}
+	tmpl, err := template.New(c.Path).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse template for %s", c.Path)
+	}
+	return &allowFileWriter{
+		conf:     c,
+		tmpl:     tmpl,
+		executor: executor,
+	}, nil
+}
+
+// updateAllowFiles renders all allow files from current allowances for the service of the streamer in the backend.
+func (s *streamer) updateAllowFiles(ctx context.Context) error {
+	evs, err := s.activeEvents()
+	if err != nil {
+		return err
+	}
+	entries := make([]AllowFileEntry, 0, len(evs))
+	for _, ev := range evs {
+		entries = append(entries, AllowFileEntry{
+			Address:  ev.address,
+			CIDR:     ev.CIDR(),
+			Identity: ev.identity,
+			Expires:  ev.expires,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CIDR < entries[j].CIDR
+	})
+	writers, err := s.allowFileWriters()
+	if err != nil {
+		return err
+	}
+	for _, w := range writers {
+		if err := w.write(ctx, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *streamer) allowFileWriters() ([]*allowFileWriter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.allowFiles != nil {
+		return s.allowFiles, nil
+	}
+	writers := make([]*allowFileWriter, 0, len(s.conf.AllowFiles))
+	for _, c := range s.conf.AllowFiles {
+		w, err := newAllowFileWriter(c, s.executor)
+		if err != nil {
+			return nil, err
+		}
+		w.dryRun = s.conf.DryRun
+		writers = append(writers, w)
+	}
+	s.allowFiles = writers
+	return writers, nil
+}
+
+// write renders the file atomically, and reloads when the content is changed.
+func (w *allowFileWriter) write(ctx context.Context, entries []AllowFileEntry) error {
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, entries); err != nil {
+		return errors.Wrapf(err, "failed to render %s", w.conf.Path)
+	}
+	if current, err := ioutil.ReadFile(w.conf.Path); err == nil && bytes.Equal(current, buf.Bytes()) {
+		log.Printf("[debug] %s is not changed", w.conf.Path)
+		return nil
+	}
+	if w.dryRun {
+		log.Printf("[info] (dry-run) write %s entries:%d and reload\n%s", w.conf.Path, len(entries), buf.String())
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(w.conf.Path), "."+filepath.Base(w.conf.Path))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a temporary file for %s", w.conf.Path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tmp.Name())
+	}
+	if err := os.Chmod(tmp.Name(), w.conf.fileMode()); err != nil {
+		return errors.Wrapf(err, "failed to chmod %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), w.conf.Path); err != nil {
+		return errors.Wrapf(err, "failed to rename %s to %s", tmp.Name(), w.conf.Path)
+	}
+	log.Printf("[info] wrote %s entries:%d", w.conf.Path, len(entries))
+	return w.reload(ctx)
+}
+
+// reload runs the reload command.
+// When ReloadDelay is set, reloads in the delay are debounced into one.
+func (w *allowFileWriter) reload(ctx context.Context) error {
+	if w.conf.ReloadCommand == "" {
+		return nil
+	}
+	if w.conf.ReloadDelay <= 0 {
+		return w.runReloadCommand(ctx)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		log.Printf("[debug] reload for %s is already scheduled", w.conf.Path)
+		return nil
+	}
+	log.Printf("[debug] reload for %s is scheduled after %s", w.conf.Path, w.conf.ReloadDelay)
+	w.timer = time.AfterFunc(w.conf.ReloadDelay, func() {
+		w.mu.Lock()
+		w.timer = nil
+		w.mu.Unlock()
+		if err := w.runReloadCommand(context.Background()); err != nil {
+			log.Println("[error]", err)
+		}
+	})
+	return nil
+}
+
+func (w *allowFileWriter) runReloadCommand(ctx context.Context) error {
+	log.Printf("[info] reloading for %s: %s", w.conf.Path, w.conf.ReloadCommand)
+	return w.executor.Execute(ctx, "", "sh", "-c", w.conf.ReloadCommand)
+}
+
+func (c *AllowFileConfig) fileMode() os.FileMode {
+	if c.Mode == 0 {
+		return 0644
+	}
+	return os.FileMode(c.Mode)
+}
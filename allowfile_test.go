@@ -0,0 +1,136 @@
+package knockrd_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+type listBackend struct {
+	items   []knockrd.Item
+	deleted []string
+}
+
+func (b *listBackend) Set(item knockrd.Item) error   { return nil }
+func (b *listBackend) Get(key string) (bool, error)  { return false, nil }
+func (b *listBackend) Delete(key string) error       { b.deleted = append(b.deleted, key); return nil }
+func (b *listBackend) TTL() time.Duration            { return time.Hour }
+func (b *listBackend) List() ([]knockrd.Item, error) { return b.items, nil }
+func (b *listBackend) Extend(key string, expires time.Time, maxSession time.Duration) (*knockrd.Item, error) {
+	return nil, nil
+}
+
+func TestAllowFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "allow.conf")
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		AllowFiles: []*knockrd.AllowFileConfig{
+			{
+				Path:          path,
+				Format:        "nginx",
+				ReloadCommand: "nginx -s reload",
+			},
+		},
+	}
+	b := &listBackend{
+		items: []knockrd.Item{
+			{Key: "2001:db8::1"},
+			{Key: "198.51.100.123"},
+			{Key: "not an address"},
+		},
+	}
+	var commands []string
+	handler := knockrd.NewStreamHandlerWithBackend(conf, b, func(_ context.Context, stdin string, name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	})
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := handler(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "allow 198.51.100.123/32;\nallow 2001:db8::1/128;\n"
+	if string(content) != expected {
+		t.Errorf("unexpected content %q", content)
+	}
+	// reloaded only once because the content is not changed at the second time
+	if len(commands) != 1 || commands[0] != "sh -c nginx -s reload" {
+		t.Errorf("unexpected commands %#v", commands)
+	}
+}
+
+func TestAllowFileServices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allowFile := func(name string) []*knockrd.AllowFileConfig {
+		return []*knockrd.AllowFileConfig{{Path: filepath.Join(dir, name), Format: "nginx"}}
+	}
+	conf := &knockrd.Config{
+		TTL:        time.Hour,
+		AllowFiles: allowFile("top.conf"),
+		Services: []*knockrd.ServiceConfig{
+			{Name: "grafana", TTL: time.Hour, AllowFiles: allowFile("grafana.conf")},
+			{Name: "ssh-prod", TTL: time.Hour, AllowFiles: allowFile("ssh-prod.conf")},
+		},
+	}
+	b := &listBackend{
+		items: []knockrd.Item{
+			{Key: "198.51.100.1"},
+			{Key: "grafana#198.51.100.2"},
+			{Key: "ssh-prod#198.51.100.3"},
+			{Key: "ssh-prod#2001:db8::3"},
+		},
+	}
+	handler := knockrd.NewStreamHandlerWithBackend(conf, b, func(_ context.Context, stdin string, name string, args ...string) error {
+		return nil
+	})
+	var ev events.DynamoDBEvent
+	for _, key := range []string{"198.51.100.1", "grafana#198.51.100.2", "ssh-prod#198.51.100.3"} {
+		ev.Records = append(ev.Records, events.DynamoDBEventRecord{
+			EventName: "INSERT",
+			Change: events.DynamoDBStreamRecord{
+				Keys: map[string]events.DynamoDBAttributeValue{"Key": events.NewStringAttribute(key)},
+			},
+		})
+	}
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"top.conf":      "allow 198.51.100.1/32;\n",
+		"grafana.conf":  "allow 198.51.100.2/32;\n",
+		"ssh-prod.conf": "allow 198.51.100.3/32;\nallow 2001:db8::3/128;\n",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("unexpected content of %s %q", name, content)
+		}
+	}
+}
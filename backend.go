@@ -4,11 +4,12 @@ import (
 	"context"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ReneKroon/ttlcache"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/guregu/dynamo"
 	"github.com/pkg/errors"
 	"github.com/shogo82148/go-retry"
@@ -25,18 +26,45 @@ var retryPolicy = retry.Policy{
 }
 
 type Backend interface {
-	Set(string) error
+	Set(Item) error
 	Get(string) (bool, error)
 	Delete(string) error
 	TTL() time.Duration
+	List() ([]Item, error)
+	// Extend updates the expiry of the alive item, and returns the updated item.
+	// The expiry is capped at Created + maxSession (zero means unlimited), and never shortened.
+	// It returns nil when the item is not found or expired.
+	Extend(key string, expires time.Time, maxSession time.Duration) (*Item, error)
 }
 
 type Item struct {
-	Key     string `dynamo:"Key,hash"`
-	Expires int64  `dynamo:"Expires"`
+	Key      string `dynamo:"Key,hash"`
+	Expires  int64  `dynamo:"Expires"`
+	Identity string `dynamo:"Identity,omitempty"`
+	Created  int64  `dynamo:"Created,omitempty"` // start of the session. kept by Extend
+}
+
+// extendedExpires returns Expires of the item extended until expires.
+// Items without Created (stored by older versions) are regarded as created at now.
+func (item Item) extendedExpires(expires time.Time, maxSession time.Duration, now time.Time) int64 {
+	created := item.Created
+	if created == 0 {
+		created = now.Unix()
+	}
+	ts := expires.Unix()
+	if max := time.Unix(created, 0).Add(maxSession).Unix(); maxSession > 0 && ts > max {
+		ts = max
+	}
+	if ts < item.Expires {
+		return item.Expires
+	}
+	return ts
 }
 
 type DynamoDBBackend struct {
+	// OnExpire is called for items deleted by Sweep.
+	OnExpire func(Item)
+
 	db        *dynamo.DB
 	TableName string
 	ttl       time.Duration
@@ -44,20 +72,14 @@ type DynamoDBBackend struct {
 
 func NewDynamoDBBackend(conf *Config) (Backend, error) {
 	log.Println("[debug] initialize dynamodb backend")
-	awsCfg := &aws.Config{
-		Region: aws.String(conf.AWS.Region),
-	}
-	if conf.AWS.Endpoint != "" {
-		awsCfg.Endpoint = aws.String(conf.AWS.Endpoint)
-	}
-	db := dynamo.New(session.New(), awsCfg)
+	db := dynamo.New(session.New(), conf.awsConfig(conf.AWS.Region))
 	name := conf.TableName
 	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
 	defer cancel()
-	if _, err := db.Table(name).Describe().RunWithContext(ctx); err != nil {
+	if desc, err := db.Table(name).Describe().RunWithContext(ctx); err != nil {
 		log.Printf("[info] describe table %s failed, creating: %s", name, err)
 		// table not exists
-		if err := db.CreateTable(name, Item{}).OnDemand(true).Stream(dynamo.KeysOnlyView).RunWithContext(ctx); err != nil {
+		if err := db.CreateTable(name, Item{}).OnDemand(true).Stream(dynamo.NewAndOldImagesView).RunWithContext(ctx); err != nil {
 			return nil, errors.Wrapf(err, "failed to create table %s", name)
 		}
 		log.Printf("[info] enabling TTL for %s", name)
@@ -67,6 +89,12 @@ func NewDynamoDBBackend(conf *Config) (Backend, error) {
 			return nil, errors.Wrapf(err, "failed to set TTL for %s.Expires", name)
 		}
 	} else {
+		if desc.StreamView != dynamo.NewAndOldImagesView {
+			log.Printf(
+				"[warn] StreamViewType of %s is %s. %s is required to pass attributes of items (e.g. identity) to targets",
+				name, desc.StreamView, dynamo.NewAndOldImagesView,
+			)
+		}
 		dt, err := db.Table(name).DescribeTTL().RunWithContext(ctx)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to describe TTL for %s", name)
@@ -109,16 +137,18 @@ func (d *DynamoDBBackend) Get(key string) (bool, error) {
 	return ts <= item.Expires, nil
 }
 
-func (d *DynamoDBBackend) Set(key string) error {
-	expireAt := time.Now().Add(d.TTL())
-	table := d.db.Table(d.TableName)
-	item := Item{
-		Key:     key,
-		Expires: expireAt.Unix(),
+// Set puts the item. When item.Expires is zero, the item expires after TTL.
+func (d *DynamoDBBackend) Set(item Item) error {
+	if item.Expires == 0 {
+		item.Expires = time.Now().Add(d.TTL()).Unix()
+	}
+	if item.Created == 0 {
+		item.Created = time.Now().Unix()
 	}
+	table := d.db.Table(d.TableName)
 	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
 	defer cancel()
-	log.Printf("[debug] set %s to dynamodb", key)
+	log.Printf("[debug] set %s to dynamodb", item.Key)
 	return table.Put(item).RunWithContext(ctx)
 }
 
@@ -130,10 +160,72 @@ func (d *DynamoDBBackend) Delete(key string) error {
 	return table.Delete("Key", key).RunWithContext(ctx)
 }
 
+// Extend updates Expires of the item by a conditional update, so the stream has a MODIFY record.
+// The update fails when the item is changed after it is read, and the item is regarded as not found.
+func (d *DynamoDBBackend) Extend(key string, expires time.Time, maxSession time.Duration) (*Item, error) {
+	table := d.db.Table(d.TableName)
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	now := time.Now()
+	var item Item
+	if err := table.Get("Key", key).Consistent(true).OneWithContext(ctx, &item); err != nil {
+		if strings.Contains(err.Error(), "no item found") {
+			err = nil
+		}
+		return nil, err
+	}
+	if item.Expires < now.Unix() {
+		return nil, nil
+	}
+	ts := item.extendedExpires(expires, maxSession, now)
+	if ts == item.Expires && item.Created != 0 {
+		return &item, nil
+	}
+	log.Printf("[debug] extend %s in dynamodb until %s", key, time.Unix(ts, 0).Format(time.RFC3339))
+	u := table.Update("Key", key).
+		Set("Expires", ts).
+		If("'Expires' = ?", item.Expires)
+	if item.Created == 0 {
+		u = u.Set("Created", now.Unix()).If("attribute_not_exists('Created')")
+	} else {
+		u = u.If("'Created' = ?", item.Created)
+	}
+	var updated Item
+	err := u.ValueWithContext(ctx, &updated)
+	if isAWSErrorCode(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
 func (d *DynamoDBBackend) TTL() time.Duration {
 	return d.ttl
 }
 
+// List returns all items which are not expired.
+func (d *DynamoDBBackend) List() ([]Item, error) {
+	table := d.db.Table(d.TableName)
+	var items []Item
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	log.Printf("[debug] scan %s", d.TableName)
+	if err := table.Scan().AllWithContext(ctx, &items); err != nil {
+		return nil, errors.Wrapf(err, "failed to scan %s", d.TableName)
+	}
+	ts := time.Now().Unix()
+	res := make([]Item, 0, len(items))
+	for _, item := range items {
+		if item.Expires < ts {
+			log.Printf("[debug] %s is expired", item.Key)
+			continue
+		}
+		res = append(res, item)
+	}
+	return res, nil
+}
+
 type CachedBackend struct {
 	backend Backend
 	cache   *ttlcache.Cache
@@ -152,9 +244,10 @@ func NewCachedBackend(backend Backend, ttl time.Duration) (Backend, error) {
 	}, nil
 }
 
-func (b *CachedBackend) Set(key string) error {
+func (b *CachedBackend) Set(item Item) error {
+	key := item.Key
 	log.Printf("[debug] set %s to backend", key)
-	if err := b.backend.Set(key); err != nil {
+	if err := b.backend.Set(item); err != nil {
 		b.cache.Remove(key)
 		return err
 	}
@@ -200,10 +293,143 @@ func (b *CachedBackend) Delete(key string) error {
 	return b.backend.Delete(key)
 }
 
+func (b *CachedBackend) Extend(key string, expires time.Time, maxSession time.Duration) (*Item, error) {
+	item, err := b.backend.Extend(key, expires, maxSession)
+	if item == nil && isCachable(key) {
+		log.Printf("[debug] delete %s from cache", key)
+		b.cache.Remove(key)
+	}
+	return item, err
+}
+
 func (b *CachedBackend) TTL() time.Duration {
 	return b.backend.TTL()
 }
 
+func (b *CachedBackend) List() ([]Item, error) {
+	return b.backend.List()
+}
+
 func isCachable(key string) bool {
 	return !strings.HasPrefix(key, noCachePrefix)
 }
+
+// MemoryBackend stores items in the process memory.
+// Expired items are removed periodically, and passed to OnExpire.
+type MemoryBackend struct {
+	OnExpire func(Item)
+
+	mu            sync.Mutex
+	items         map[string]Item
+	ttl           time.Duration
+	sweepInterval time.Duration
+}
+
+func NewMemoryBackend(conf *Config) (*MemoryBackend, error) {
+	log.Println("[debug] initialize memory backend")
+	return newMemoryBackend(conf.TTL, time.Second), nil
+}
+
+func newMemoryBackend(ttl, sweepInterval time.Duration) *MemoryBackend {
+	b := &MemoryBackend{
+		items:         make(map[string]Item),
+		ttl:           ttl,
+		sweepInterval: sweepInterval,
+	}
+	go b.sweeper()
+	return b
+}
+
+// Set puts the item. When item.Expires is zero, the item expires after TTL.
+func (b *MemoryBackend) Set(item Item) error {
+	if item.Expires == 0 {
+		item.Expires = time.Now().Add(b.TTL()).Unix()
+	}
+	if item.Created == 0 {
+		item.Created = time.Now().Unix()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log.Printf("[debug] set %s to memory", item.Key)
+	b.items[item.Key] = item
+	return nil
+}
+
+func (b *MemoryBackend) Get(key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	item, ok := b.items[key]
+	return ok && time.Now().Unix() <= item.Expires, nil
+}
+
+func (b *MemoryBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log.Printf("[debug] delete %s from memory", key)
+	delete(b.items, key)
+	return nil
+}
+
+func (b *MemoryBackend) Extend(key string, expires time.Time, maxSession time.Duration) (*Item, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	item, ok := b.items[key]
+	if !ok || now.Unix() > item.Expires {
+		return nil, nil
+	}
+	item.Expires = item.extendedExpires(expires, maxSession, now)
+	if item.Created == 0 {
+		item.Created = now.Unix()
+	}
+	log.Printf("[debug] extend %s in memory until %s", key, time.Unix(item.Expires, 0).Format(time.RFC3339))
+	b.items[key] = item
+	return &item, nil
+}
+
+func (b *MemoryBackend) TTL() time.Duration {
+	return b.ttl
+}
+
+// List returns all items which are not expired.
+func (b *MemoryBackend) List() ([]Item, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ts := time.Now().Unix()
+	res := make([]Item, 0, len(b.items))
+	for _, item := range b.items {
+		if item.Expires < ts {
+			continue
+		}
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+func (b *MemoryBackend) sweeper() {
+	ticker := time.NewTicker(b.sweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, item := range b.sweep() {
+			if b.OnExpire != nil {
+				b.OnExpire(item)
+			}
+		}
+	}
+}
+
+// sweep removes expired items and returns them.
+func (b *MemoryBackend) sweep() []Item {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ts := time.Now().Unix()
+	var expired []Item
+	for key, item := range b.items {
+		if item.Expires < ts {
+			log.Printf("[debug] %s is expired", key)
+			delete(b.items, key)
+			expired = append(expired, item)
+		}
+	}
+	return expired
+}
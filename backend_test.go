@@ -1,9 +1,11 @@
 package knockrd_test
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -95,7 +97,7 @@ func testBackend(t *testing.T, b knockrd.Backend, prefix string) {
 		}
 	}
 
-	if err := b.Set(key); err != nil {
+	if err := b.Set(knockrd.Item{Key: key}); err != nil {
 		t.Error(err)
 	}
 	defer func(key string) {
@@ -124,3 +126,97 @@ func testBackend(t *testing.T, b knockrd.Backend, prefix string) {
 		t.Errorf("unexpected %s found", key)
 	}
 }
+
+func TestDynamoDBBackendSweep(t *testing.T) {
+	if !doTestBackend {
+		t.Skip("skip backend test")
+		return
+	}
+	b, err := knockrd.NewDynamoDBBackend(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := b.(*knockrd.DynamoDBBackend)
+	var expired []string
+	db.OnExpire = func(item knockrd.Item) {
+		expired = append(expired, item.Key)
+	}
+	now := time.Now()
+	if err := db.Set(knockrd.Item{Key: "192.0.2.10", Expires: now.Add(-time.Minute).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(knockrd.Item{Key: "192.0.2.11", Expires: now.Add(time.Minute).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Delete("192.0.2.11")
+
+	ctx := context.Background()
+	if ok, err := db.AcquireSweeperLock(ctx, "foo", time.Minute); err != nil || !ok {
+		t.Errorf("failed to acquire lock %t %s", ok, err)
+	}
+	if ok, err := db.AcquireSweeperLock(ctx, "bar", time.Minute); err != nil || ok {
+		t.Errorf("unexpected lock by another owner %t %s", ok, err)
+	}
+	if ok, err := db.AcquireSweeperLock(ctx, "foo", -time.Minute); err != nil || !ok {
+		t.Errorf("failed to renew lock %t %s", ok, err)
+	}
+	if ok, err := db.AcquireSweeperLock(ctx, "bar", time.Minute); err != nil || !ok {
+		t.Errorf("failed to take over expired lock %t %s", ok, err)
+	}
+
+	deleted, err := db.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, item := range deleted {
+		keys = append(keys, item.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"192.0.2.10"}) || !reflect.DeepEqual(expired, keys) {
+		t.Errorf("unexpected deleted %v expired %v", keys, expired)
+	}
+	if items, err := db.List(); err != nil {
+		t.Error(err)
+	} else {
+		found := false
+		for _, item := range items {
+			found = found || item.Key == "192.0.2.11"
+		}
+		if !found {
+			t.Error("active item is deleted")
+		}
+	}
+}
+
+func TestDynamoDBBackendExtend(t *testing.T) {
+	if !doTestBackend {
+		t.Skip("skip backend test")
+		return
+	}
+	b, err := knockrd.NewDynamoDBBackend(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := b.Set(knockrd.Item{Key: "192.0.2.20", Identity: "foo@example.com", Created: now.Add(-time.Hour).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete("192.0.2.20")
+
+	item, err := b.Extend("192.0.2.20", now.Add(time.Hour), 3*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || item.Expires != now.Add(time.Hour).Unix() || item.Identity != "foo@example.com" {
+		t.Errorf("unexpected extended item %#v", item)
+	}
+	if item, err := b.Extend("192.0.2.20", now.Add(3*time.Hour), 3*time.Hour); err != nil || item == nil || item.Expires != now.Add(2*time.Hour).Unix() {
+		t.Errorf("must be capped at the max session %#v %s", item, err)
+	}
+	if item, err := b.Extend("192.0.2.20", now.Add(time.Hour), 0); err != nil || item == nil || item.Expires != now.Add(2*time.Hour).Unix() {
+		t.Errorf("must not be shortened %#v %s", item, err)
+	}
+	if item, err := b.Extend("192.0.2.21", now.Add(time.Hour), 0); err != nil || item != nil {
+		t.Errorf("must not be extended for a missing item %#v %s", item, err)
+	}
+}
@@ -0,0 +1,52 @@
+package knockrd
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+// DynamoDBEventResponse is a response of the stream function for ReportBatchItemFailures.
+type DynamoDBEventResponse struct {
+	BatchItemFailures []DynamoDBBatchItemFailure `json:"batchItemFailures"`
+}
+
+// DynamoDBBatchItemFailure represents a failed record by the sequence number.
+type DynamoDBBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// batchItemFailureError is returned when the record and following records in a batch are not processed.
+type batchItemFailureError struct {
+	sequenceNumber string
+	err            error
+}
+
+func (e *batchItemFailureError) Error() string {
+	return "failed to process the record " + e.sequenceNumber + ": " + e.err.Error()
+}
+
+func (e *batchItemFailureError) Cause() error {
+	return e.err
+}
+
+// NewBatchItemFailuresHandler wraps the stream handler to report the first failed record to Lambda.
+// Lambda retries the batch from the record, so records processed successfully are not retried.
+func NewBatchItemFailuresHandler(h func(context.Context, events.DynamoDBEvent) error) func(context.Context, events.DynamoDBEvent) (DynamoDBEventResponse, error) {
+	return func(ctx context.Context, event events.DynamoDBEvent) (DynamoDBEventResponse, error) {
+		var res DynamoDBEventResponse
+		err := h(ctx, event)
+		if err == nil {
+			return res, nil
+		}
+		var bf *batchItemFailureError
+		if !errors.As(err, &bf) {
+			return res, err
+		}
+		log.Printf("[warn] report a batch item failure: %s", err)
+		res.BatchItemFailures = []DynamoDBBatchItemFailure{{ItemIdentifier: bf.sequenceNumber}}
+		return res, nil
+	}
+}
@@ -0,0 +1,142 @@
+package knockrd_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+func TestBatchItemFailures(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+	}))
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Firewall: &knockrd.FirewallConfig{
+			Type:  knockrd.FirewallTypeIPSet,
+			SetV4: "knockrd",
+			SetV6: "knockrd6",
+		},
+		Webhooks: []*knockrd.WebhookConfig{
+			{URL: ts.URL, Secret: "secret"},
+		},
+	}
+	var commands []string
+	handler := knockrd.NewStreamHandlerWithExecutor(conf, func(_ context.Context, _ string, name string, args ...string) error {
+		cmd := name + " " + strings.Join(args, " ")
+		commands = append(commands, cmd)
+		if strings.Contains(cmd, "2001:db8::1") {
+			return errors.New("ipset failed")
+		}
+		return nil
+	})
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	res, err := knockrd.NewBatchItemFailuresHandler(handler)(context.Background(), ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []knockrd.DynamoDBBatchItemFailure{{ItemIdentifier: "222"}}
+	if len(res.BatchItemFailures) != 1 || res.BatchItemFailures[0] != expected[0] {
+		t.Errorf("unexpected batch item failures %#v", res.BatchItemFailures)
+	}
+
+	// the firewall is applied record by record until the failed record
+	expectedCommands := []string{
+		"ipset del knockrd 198.51.100.1/32 -exist",
+		"ipset add knockrd 198.51.100.123/32 timeout 3600 -exist",
+		"ipset add knockrd6 2001:db8::1/128 timeout 3600 -exist",
+		"ipset add knockrd 198.51.100.1/32 timeout 3600 -exist",
+		"ipset add knockrd6 2001:db8::1/128 timeout 3600 -exist",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expectedCommands, "\n") {
+		t.Errorf("unexpected commands %#v", commands)
+	}
+
+	// the webhook is not blocked by the failure of the firewall
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 3 {
+		t.Errorf("unexpected webhooks %#v", bodies)
+	}
+}
+
+func TestBatchItemFailuresOfBatchSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Firewall: &knockrd.FirewallConfig{
+			Type:  knockrd.FirewallTypeIPSet,
+			SetV4: "knockrd",
+			SetV6: "knockrd6",
+		},
+		AllowFiles: []*knockrd.AllowFileConfig{
+			{
+				Path:          filepath.Join(dir, "allow.conf"),
+				Format:        "nginx",
+				ReloadCommand: "nginx -s reload",
+			},
+		},
+	}
+	b := &listBackend{
+		items: []knockrd.Item{{Key: "198.51.100.123"}},
+	}
+	var commands, reloads []string
+	handler := knockrd.NewStreamHandlerWithBackend(conf, b, func(_ context.Context, _ string, name string, args ...string) error {
+		cmd := name + " " + strings.Join(args, " ")
+		if name == "sh" {
+			reloads = append(reloads, cmd)
+			return errors.New("reload failed")
+		}
+		commands = append(commands, cmd)
+		if strings.Contains(cmd, "2001:db8::1") {
+			return errors.New("ipset failed")
+		}
+		return nil
+	})
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	res, err := knockrd.NewBatchItemFailuresHandler(handler)(context.Background(), ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the whole batch is retried from the first record without replaying
+	expected := []knockrd.DynamoDBBatchItemFailure{{ItemIdentifier: "111"}}
+	if len(res.BatchItemFailures) != 1 || res.BatchItemFailures[0] != expected[0] {
+		t.Errorf("unexpected batch item failures %#v", res.BatchItemFailures)
+	}
+	if len(commands) != 3 {
+		t.Errorf("the firewall must not be applied again %#v", commands)
+	}
+	if len(reloads) != 1 {
+		t.Errorf("allow files must not be applied again %#v", reloads)
+	}
+}
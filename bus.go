@@ -0,0 +1,139 @@
+package knockrd
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// eventBusBatchSize is the max number of events dispatched at once.
+const eventBusBatchSize = 100
+
+// eventBus delivers changes of allowances from backends to targets in the process.
+// Events are dispatched in order by a goroutine.
+type eventBus struct {
+	queue    chan ipSetEvent
+	handlers []func(context.Context, []ipSetEvent) error
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		queue: make(chan ipSetEvent, eventBusBatchSize*10),
+	}
+}
+
+// subscribe adds the handler. It must be called before run.
+func (b *eventBus) subscribe(h func(context.Context, []ipSetEvent) error) {
+	b.handlers = append(b.handlers, h)
+}
+
+// publish queues the event without blocking. When the queue is full, the event is dropped
+// (reconciliation fixes it only in targets covered by Reconcile).
+func (b *eventBus) publish(ev ipSetEvent) {
+	select {
+	case b.queue <- ev:
+		log.Printf("[debug] publish %s %s", addOrRemove(ev.add), ev.CIDR())
+	default:
+		log.Printf("[warn] event queue is full, dropped %s %s", addOrRemove(ev.add), ev.CIDR())
+	}
+}
+
+// run dispatches events to handlers until the context is canceled.
+// Handlers retry failed events by themselves, and failed events are dropped after that.
+func (b *eventBus) run(ctx context.Context) {
+	for {
+		var evs []ipSetEvent
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-b.queue:
+			evs = append(evs, ev)
+		}
+	drain:
+		for len(evs) < eventBusBatchSize {
+			select {
+			case ev := <-b.queue:
+				evs = append(evs, ev)
+			default:
+				break drain
+			}
+		}
+		for _, h := range b.handlers {
+			if err := h(ctx, evs); err != nil {
+				log.Printf("[error] failed to handle %d events: %s", len(evs), err)
+			}
+		}
+	}
+}
+
+// publishingBackend publishes changes of items to the event bus.
+type publishingBackend struct {
+	Backend
+	bus *eventBus
+}
+
+// Set puts the item and publishes an event which adds the address.
+func (b *publishingBackend) Set(item Item) error {
+	if item.Expires == 0 {
+		item.Expires = time.Now().Add(b.TTL()).Unix()
+	}
+	if err := b.Backend.Set(item); err != nil {
+		return err
+	}
+	if ev := newIPSetEvent(item.Key, true); ev != nil {
+		ev.identity = item.Identity
+		ev.expires = time.Unix(item.Expires, 0)
+		b.bus.publish(*ev)
+	}
+	return nil
+}
+
+// Extend extends the item and publishes an event which updates the expiry of the address.
+func (b *publishingBackend) Extend(key string, expires time.Time, maxSession time.Duration) (*Item, error) {
+	item, err := b.Backend.Extend(key, expires, maxSession)
+	if err != nil || item == nil {
+		return item, err
+	}
+	if ev := newIPSetEvent(item.Key, true); ev != nil {
+		ev.identity = item.Identity
+		ev.expires = time.Unix(item.Expires, 0)
+		b.bus.publish(*ev)
+	}
+	return item, nil
+}
+
+// Delete deletes the item and publishes an event which removes the address.
+func (b *publishingBackend) Delete(key string) error {
+	if err := b.Backend.Delete(key); err != nil {
+		return err
+	}
+	if ev := newIPSetEvent(key, false); ev != nil {
+		b.bus.publish(*ev)
+	}
+	return nil
+}
+
+// newInProcessBackend wraps the backend to apply changes to targets by the streamer in the process.
+// Targets covered by Reconcile are reconciled with the backend before dispatching events.
+func newInProcessBackend(ctx context.Context, b Backend, s *streamer) Backend {
+	bus := newEventBus()
+	bus.subscribe(s.handleEvents)
+	onExpire := func(item Item) {
+		if ev := newIPSetEvent(item.Key, false); ev != nil {
+			bus.publish(*ev)
+		}
+	}
+	switch b := b.(type) {
+	case *MemoryBackend:
+		b.OnExpire = onExpire
+	case *DynamoDBBackend:
+		b.OnExpire = onExpire
+	}
+	go func() {
+		if _, err := s.Reconcile(ctx, b, false); err != nil {
+			log.Println("[error] failed to reconcile targets:", err)
+		}
+		bus.run(ctx)
+	}()
+	return &publishingBackend{Backend: b, bus: bus}
+}
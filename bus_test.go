@@ -0,0 +1,155 @@
+package knockrd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/knockrd"
+)
+
+var timeoutRegexp = regexp.MustCompile(`timeout \d+`)
+
+func TestInProcessBackend(t *testing.T) {
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Firewall: &knockrd.FirewallConfig{
+			Type:  knockrd.FirewallTypeIPSet,
+			SetV4: "knockrd",
+		},
+	}
+	var mu sync.Mutex
+	var commands []string
+	executed := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := knockrd.NewInProcessMemoryBackend(ctx, conf, func(_ context.Context, _ string, name string, args ...string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		cmd := name + " " + strings.Join(args, " ")
+		commands = append(commands, timeoutRegexp.ReplaceAllString(cmd, "timeout N"))
+		executed <- struct{}{}
+		return nil
+	})
+	wait := func() {
+		select {
+		case <-executed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	if err := b.Set(knockrd.Item{Key: "csrf-token"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(knockrd.Item{Key: "198.51.100.1"}); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	if ok, err := b.Get("198.51.100.1"); err != nil || !ok {
+		t.Errorf("198.51.100.1 must be allowed %t %v", ok, err)
+	}
+	if err := b.Delete("198.51.100.1"); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	// expires soon
+	if err := b.Set(knockrd.Item{Key: "198.51.100.2", Expires: time.Now().Add(2 * time.Second).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	wait() // add
+	wait() // remove by expiration
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"ipset add knockrd 198.51.100.1/32 timeout N -exist",
+		"ipset del knockrd 198.51.100.1/32 -exist",
+		"ipset add knockrd 198.51.100.2/32 timeout N -exist",
+		"ipset del knockrd 198.51.100.2/32 -exist",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands %#v", commands)
+	}
+}
+
+func TestEventBusFull(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 1010; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	done := make(chan int)
+	go func() {
+		done <- knockrd.PublishEvents(addrs)
+	}()
+	select {
+	case n := <-done:
+		// overflowed events are dropped
+		if n != 1000 {
+			t.Errorf("unexpected queued events %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish is blocked")
+	}
+}
+
+func TestInProcessBackendRetry(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+	}))
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Firewall: &knockrd.FirewallConfig{
+			Type:  knockrd.FirewallTypeIPSet,
+			SetV4: "knockrd",
+		},
+		Webhooks: []*knockrd.WebhookConfig{
+			{URL: ts.URL, Secret: "secret"},
+		},
+	}
+	var commands int
+	executed := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := knockrd.NewInProcessMemoryBackend(ctx, conf, func(_ context.Context, _ string, name string, args ...string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		commands++
+		if commands == 1 {
+			return errors.New("ipset failed")
+		}
+		executed <- struct{}{}
+		return nil
+	})
+	if err := b.Set(knockrd.Item{Key: "198.51.100.1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-executed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if commands != 2 {
+		t.Errorf("unexpected commands %d", commands)
+	}
+	// only the failed firewall is retried
+	if requests != 1 {
+		t.Errorf("webhooks must not be sent again %d", requests)
+	}
+}
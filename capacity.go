@@ -0,0 +1,219 @@
+package knockrd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+)
+
+// capacityBucket is a target (or a part of a target) which holds limited entries.
+// A chain of buckets (a target and its spillover targets) is filled in order.
+type capacityBucket struct {
+	name    string
+	max     int        // max units
+	cost    int        // units per entry
+	used    int        // used units including entries not managed by knockrd
+	entries mapset.Set // entries in the bucket
+	managed mapset.Set // entries which may be evicted
+
+	add    []string
+	remove []string
+}
+
+func newCapacityBucket(name string, max, cost, used int, entries, managed mapset.Set) *capacityBucket {
+	if cost <= 0 {
+		cost = 1
+	}
+	return &capacityBucket{
+		name:    name,
+		max:     max,
+		cost:    cost,
+		used:    used,
+		entries: entries,
+		managed: managed,
+	}
+}
+
+func (b *capacityBucket) hasRoom() bool {
+	return b.used+b.cost <= b.max
+}
+
+func (b *capacityBucket) put(entry string) {
+	b.entries.Add(entry)
+	b.managed.Add(entry)
+	b.used += b.cost
+	b.add = append(b.add, entry)
+}
+
+func (b *capacityBucket) delete(entry string) {
+	b.entries.Remove(entry)
+	b.managed.Remove(entry)
+	b.used -= b.cost
+	b.remove = append(b.remove, entry)
+}
+
+func (b *capacityBucket) changed() bool {
+	return len(b.add)+len(b.remove) > 0
+}
+
+// capacityPlanner places entries into a chain of buckets.
+type capacityPlanner struct {
+	s       *streamer
+	buckets []*capacityBucket
+	evict   bool
+
+	active map[string]ipSetEvent // by CIDR, loaded on the first eviction
+}
+
+func (s *streamer) newCapacityPlanner(buckets []*capacityBucket, evict bool) *capacityPlanner {
+	return &capacityPlanner{
+		s:       s,
+		buckets: buckets,
+		evict:   evict && s.conf.Capacity.Eviction == EvictionOldest,
+	}
+}
+
+// place removes entries from buckets which contain them, and adds entries to the first bucket which has room.
+// Entries already in a bucket are kept in it. When all buckets are full, an entry is evicted if the eviction policy is oldest.
+// It returns entries which are not placed.
+func (p *capacityPlanner) place(add, remove []string) ([]string, error) {
+	for _, entry := range remove {
+		for _, b := range p.buckets {
+			if b.managed.Contains(entry) {
+				b.delete(entry)
+			}
+		}
+	}
+	adding := mapset.NewSet()
+	for _, entry := range add {
+		adding.Add(entry)
+	}
+	var unplaced []string
+ADD:
+	for _, entry := range add {
+		for _, b := range p.buckets {
+			if b.entries.Contains(entry) {
+				continue ADD
+			}
+		}
+		for _, b := range p.buckets {
+			if b.hasRoom() {
+				b.put(entry)
+				continue ADD
+			}
+		}
+		if p.evict {
+			b, err := p.evictOldest(adding)
+			if err != nil {
+				return unplaced, err
+			}
+			if b != nil {
+				b.put(entry)
+				continue ADD
+			}
+		}
+		unplaced = append(unplaced, entry)
+	}
+	p.report()
+	return unplaced, nil
+}
+
+// evictOldest evicts an entry from the buckets to make room, and returns the bucket which has room.
+// Entries not allowed in the backend (stale) are evicted first, and then the allowance which expires first.
+// Evicted allowances are deleted from the backend.
+func (p *capacityPlanner) evictOldest(exclude mapset.Set) (*capacityBucket, error) {
+	if p.active == nil {
+		evs, err := p.s.activeEvents()
+		if err != nil {
+			return nil, err
+		}
+		p.active = make(map[string]ipSetEvent, len(evs))
+		for _, ev := range evs {
+			p.active[ev.CIDR()] = ev
+		}
+	}
+	var victim string
+	var victimBucket *capacityBucket
+	var victimExpires time.Time
+	var stale bool
+	for _, b := range p.buckets {
+		for _, v := range b.managed.ToSlice() {
+			entry := v.(string)
+			if exclude.Contains(entry) {
+				continue
+			}
+			ev, ok := p.active[entry]
+			if !ok {
+				victim, victimBucket, stale = entry, b, true
+				break
+			}
+			if victim == "" || ev.expires.Before(victimExpires) || (ev.expires.Equal(victimExpires) && entry < victim) {
+				victim, victimBucket, victimExpires = entry, b, ev.expires
+			}
+		}
+		if stale {
+			break
+		}
+	}
+	if victim == "" {
+		return nil, nil
+	}
+	victimBucket.delete(victim)
+	putMetric("Evictions", 1, "Count", map[string]string{"Target": victimBucket.name})
+	if stale {
+		log.Printf("[warn] evict stale %s from %s", victim, victimBucket.name)
+		return victimBucket, nil
+	}
+	ev := p.active[victim]
+	log.Printf("[warn] evict %s identity:%s expires:%s from %s", victim, ev.identity, ev.expires.Format(time.RFC3339), victimBucket.name)
+	delete(p.active, victim)
+	if p.s.skipByDryRun("delete %s from the backend", ev.key()) {
+		return victimBucket, nil
+	}
+	b, err := p.s.getBackend()
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Delete(ev.key()); err != nil {
+		return nil, err
+	}
+	return victimBucket, nil
+}
+
+// report puts metrics of usage, and warns when usage of buckets exceeds the warning ratio.
+func (p *capacityPlanner) report() {
+	ratio := p.s.conf.Capacity.WarningRatio
+	if ratio == 0 {
+		ratio = DefaultCapacityWarningRatio
+	}
+	for _, b := range p.buckets {
+		putMetric("CapacityUsage", float64(b.used)/float64(b.max)*100, "Percent", map[string]string{"Target": b.name})
+		if float64(b.used) >= float64(b.max)*ratio {
+			log.Printf("[warn] %s uses %d of %d", b.name, b.used, b.max)
+		}
+	}
+}
+
+// capacityError returns an error for entries which are not placed.
+func capacityError(buckets []*capacityBucket, unplaced []string) error {
+	if len(unplaced) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(buckets))
+	for _, b := range buckets {
+		names = append(names, b.name)
+	}
+	return fmt.Errorf("%s are full. %d entries are not added: %s", strings.Join(names, ", "), len(unplaced), strings.Join(unplaced, ", "))
+}
+
+// reportUnplaced logs entries which are not placed and puts a metric of them.
+// Retries can't place them, so they don't fail updates of knockrd-stream.
+func reportUnplaced(buckets []*capacityBucket, unplaced []string) {
+	if err := capacityError(buckets, unplaced); err != nil {
+		log.Printf("[error] %s", err)
+		putMetric("UnplacedEntries", float64(len(unplaced)), "Count", map[string]string{"Target": buckets[0].name})
+	}
+}
@@ -0,0 +1,144 @@
+package knockrd_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+// fakeWAF serves GetIPSet and UpdateIPSet of WAFv2 API.
+type fakeWAF struct {
+	mu    sync.Mutex
+	sets  map[string][]string // by ID
+	calls []string
+}
+
+func (f *fakeWAF) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var in struct {
+		ID        string   `json:"Id"`
+		Addresses []string `json:"Addresses"`
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AWSWAF_20190729.")
+	f.calls = append(f.calls, op+" "+in.ID)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch op {
+	case "GetIPSet":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"IPSet": map[string]interface{}{
+				"Id":               in.ID,
+				"Name":             in.ID,
+				"IPAddressVersion": "IPV4",
+				"Addresses":        f.sets[in.ID],
+			},
+			"LockToken": "token",
+		})
+	case "UpdateIPSet":
+		sort.Strings(in.Addresses)
+		f.sets[in.ID] = in.Addresses
+		json.NewEncoder(w).Encode(map[string]interface{}{"NextLockToken": "token"})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func testIPSetCapacity(t *testing.T, eviction string, ev events.DynamoDBEvent) (*fakeWAF, *listBackend, error) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "dummy")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "dummy")
+	f := &fakeWAF{
+		sets: map[string][]string{
+			"a": {"192.0.2.1/32", "192.0.2.2/32"},
+			"b": {"192.0.2.3/32"},
+		},
+	}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		IPSets: knockrd.IPSetsConfig{
+			V4: []*knockrd.IPSetConfig{
+				{
+					ID: "a", Name: "a", Scope: "REGIONAL", Region: "us-east-1", MaxEntries: 2,
+					Spillover: []*knockrd.IPSetConfig{
+						{ID: "b", Name: "b", Scope: "REGIONAL", Region: "us-east-1", MaxEntries: 1},
+					},
+				},
+			},
+		},
+		Capacity: knockrd.CapacityConfig{Eviction: eviction},
+	}
+	conf.AWS.Endpoint = ts.URL
+	now := time.Now()
+	b := &listBackend{
+		items: []knockrd.Item{
+			{Key: "192.0.2.1", Expires: now.Add(30 * time.Minute).Unix()},
+			{Key: "192.0.2.2", Expires: now.Add(10 * time.Minute).Unix()}, // oldest
+			{Key: "192.0.2.3", Expires: now.Add(50 * time.Minute).Unix()},
+			{Key: "198.51.100.123", Expires: now.Add(time.Hour).Unix()},
+		},
+	}
+	handler := knockrd.NewStreamHandlerWithBackend(conf, b, nil)
+	err := handler(context.Background(), ev)
+	return f, b, err
+}
+
+func TestIPSetCapacityEviction(t *testing.T) {
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	f, b, err := testIPSetCapacity(t, knockrd.EvictionOldest, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"a": {"192.0.2.1/32", "198.51.100.123/32"},
+		"b": {"192.0.2.3/32"},
+	}
+	if !reflect.DeepEqual(f.sets, expected) {
+		t.Errorf("unexpected sets %#v", f.sets)
+	}
+	if !reflect.DeepEqual(b.deleted, []string{"192.0.2.2"}) {
+		t.Errorf("unexpected deleted %#v", b.deleted)
+	}
+}
+
+func TestIPSetCapacityFull(t *testing.T) {
+	ev := insertEvent("198.51.100.8", "198.51.100.9")
+	ev.Records = append(ev.Records, events.DynamoDBEventRecord{
+		EventName: "REMOVE",
+		Change: events.DynamoDBStreamRecord{
+			Keys:           map[string]events.DynamoDBAttributeValue{"Key": events.NewStringAttribute("192.0.2.1")},
+			SequenceNumber: "3",
+		},
+	})
+	f, b, err := testIPSetCapacity(t, knockrd.EvictionNone, ev)
+	// 198.51.100.9 is not added, but it doesn't block the removal
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"a": {"192.0.2.2/32", "198.51.100.8/32"},
+		"b": {"192.0.2.3/32"},
+	}
+	if !reflect.DeepEqual(f.sets, expected) {
+		t.Errorf("unexpected sets %#v", f.sets)
+	}
+	if len(b.deleted) > 0 {
+		t.Errorf("unexpected deleted %#v", b.deleted)
+	}
+}
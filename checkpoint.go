@@ -0,0 +1,200 @@
+package knockrd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// checkpointShardEnd is a checkpoint of shards which are processed to the end.
+const checkpointShardEnd = "SHARD_END"
+
+// finishedCheckpointTTL is a period to keep checkpoints of finished shards.
+// Shards are trimmed from the stream after 24 hours.
+const finishedCheckpointTTL = 48 * time.Hour
+
+// checkpointStore stores sequence numbers of the last processed records for each shard.
+type checkpointStore interface {
+	Load(shardID string) (string, error)
+	Save(shardID, sequenceNumber string) error
+}
+
+type memoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]string
+}
+
+func newMemoryCheckpointStore() *memoryCheckpointStore {
+	return &memoryCheckpointStore{checkpoints: make(map[string]string)}
+}
+
+func (s *memoryCheckpointStore) Load(shardID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[shardID], nil
+}
+
+func (s *memoryCheckpointStore) Save(shardID, sequenceNumber string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[shardID] = sequenceNumber
+	return nil
+}
+
+type fileCheckpoint struct {
+	SequenceNumber string    `json:"sequence_number"`
+	Updated        time.Time `json:"updated"`
+}
+
+type fileCheckpoints struct {
+	StreamARN string                     `json:"stream_arn"`
+	Shards    map[string]*fileCheckpoint `json:"shards"`
+}
+
+// fileCheckpointStore stores checkpoints in a JSON file.
+type fileCheckpointStore struct {
+	path string
+	mu   sync.Mutex
+	data fileCheckpoints
+}
+
+func newFileCheckpointStore(path, streamARN string) (*fileCheckpointStore, error) {
+	s := &fileCheckpointStore{
+		path: path,
+		data: fileCheckpoints{
+			StreamARN: streamARN,
+			Shards:    make(map[string]*fileCheckpoint),
+		},
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	var data fileCheckpoints
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	if data.StreamARN != streamARN {
+		log.Printf("[warn] checkpoints in %s are for another stream %s, ignored", path, data.StreamARN)
+		return s, nil
+	}
+	if data.Shards != nil {
+		s.data.Shards = data.Shards
+	}
+	return s, nil
+}
+
+func (s *fileCheckpointStore) Load(shardID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cp, ok := s.data.Shards[shardID]; ok {
+		return cp.SequenceNumber, nil
+	}
+	return "", nil
+}
+
+// Save writes all of checkpoints to the file atomically.
+func (s *fileCheckpointStore) Save(shardID, sequenceNumber string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.data.Shards[shardID] = &fileCheckpoint{SequenceNumber: sequenceNumber, Updated: now}
+	for id, cp := range s.data.Shards {
+		if cp.SequenceNumber == checkpointShardEnd && now.Sub(cp.Updated) > finishedCheckpointTTL {
+			delete(s.data.Shards, id)
+		}
+	}
+	b, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a temporary file for %s", s.path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return errors.Wrapf(err, "failed to rename %s to %s", tmp.Name(), s.path)
+	}
+	return nil
+}
+
+type dynamoDBCheckpoint struct {
+	StreamARN      string `dynamo:"StreamARN,hash"`
+	ShardID        string `dynamo:"ShardID,range"`
+	SequenceNumber string `dynamo:"SequenceNumber"`
+	Expires        int64  `dynamo:"Expires,omitempty"`
+}
+
+// dynamoDBCheckpointStore stores checkpoints in a DynamoDB table.
+// Checkpoints of finished shards are expired by TTL of the table.
+type dynamoDBCheckpointStore struct {
+	table     dynamo.Table
+	streamARN string
+}
+
+func newDynamoDBCheckpointStore(conf *Config, name, streamARN string) (*dynamoDBCheckpointStore, error) {
+	db := dynamo.New(session.New(), conf.awsConfig(conf.AWS.Region))
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if _, err := db.Table(name).Describe().RunWithContext(ctx); err != nil {
+		log.Printf("[info] describe table %s failed, creating: %s", name, err)
+		if err := db.CreateTable(name, dynamoDBCheckpoint{}).OnDemand(true).RunWithContext(ctx); err != nil {
+			return nil, errors.Wrapf(err, "failed to create table %s", name)
+		}
+		log.Printf("[info] enabling TTL for %s", name)
+		if err := retryPolicy.Do(ctx, func() error {
+			return db.Table(name).UpdateTTL("Expires", true).RunWithContext(ctx)
+		}); err != nil {
+			return nil, errors.Wrapf(err, "failed to set TTL for %s.Expires", name)
+		}
+	}
+	return &dynamoDBCheckpointStore{
+		table:     db.Table(name),
+		streamARN: streamARN,
+	}, nil
+}
+
+func (s *dynamoDBCheckpointStore) Load(shardID string) (string, error) {
+	var cp dynamoDBCheckpoint
+	err := s.table.Get("StreamARN", s.streamARN).Range("ShardID", dynamo.Equal, shardID).Consistent(true).One(&cp)
+	if err == dynamo.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "failed to get a checkpoint of %s", shardID)
+	}
+	return cp.SequenceNumber, nil
+}
+
+func (s *dynamoDBCheckpointStore) Save(shardID, sequenceNumber string) error {
+	cp := dynamoDBCheckpoint{
+		StreamARN:      s.streamARN,
+		ShardID:        shardID,
+		SequenceNumber: sequenceNumber,
+	}
+	if sequenceNumber == checkpointShardEnd {
+		cp.Expires = time.Now().Add(finishedCheckpointTTL).Unix()
+	}
+	if err := s.table.Put(cp).Run(); err != nil {
+		return errors.Wrapf(err, "failed to put a checkpoint of %s", shardID)
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package knockrd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/pkg/errors"
+	"github.com/shogo82148/go-retry"
+)
+
+// DefaultCloudflareEndpoint is the endpoint of Cloudflare API v4.
+var DefaultCloudflareEndpoint = "https://api.cloudflare.com/client/v4"
+
+const (
+	// cloudflareIPv6PrefixLength is the longest prefix length of IPv6 CIDRs allowed in IP lists.
+	cloudflareIPv6PrefixLength = 64
+
+	cloudflareMaxRetryAfter = time.Minute
+)
+
+type cloudflareClient struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Cursors struct {
+			After string `json:"after"`
+		} `json:"cursors"`
+	} `json:"result_info"`
+}
+
+func (r *cloudflareResponse) error() error {
+	var msgs []string
+	for _, e := range r.Errors {
+		msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+	}
+	return fmt.Errorf("cloudflare API failed: %s", strings.Join(msgs, ", "))
+}
+
+type cloudflareListItem struct {
+	ID      string `json:"id,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+func newCloudflareClient(c *CloudflareListConfig) *cloudflareClient {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultCloudflareEndpoint
+	}
+	return &cloudflareClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    c.APIToken,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do calls the API. Requests are retried by retryPolicy when rate limited (after Retry-After) or server errors.
+func (cf *cloudflareClient) do(ctx context.Context, method, path string, in interface{}) (*cloudflareResponse, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	var res cloudflareResponse
+	err := retryPolicy.Do(ctx, func() error {
+		req, err := http.NewRequest(method, cf.endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return retry.MarkPermanent(err)
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+cf.token)
+		req.Header.Set("Content-Type", "application/json")
+		log.Printf("[debug] %s %s %s", method, path, string(body))
+		resp, err := cf.client.Do(req)
+		if err != nil {
+			log.Printf("[warn] %s %s failed, retrying: %s", method, path, err)
+			return err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			log.Printf("[warn] %s %s is rate limited, retrying after %s", method, path, wait)
+			select {
+			case <-ctx.Done():
+				return retry.MarkPermanent(ctx.Err())
+			case <-time.After(wait):
+			}
+			return fmt.Errorf("%s %s is rate limited", method, path)
+		case resp.StatusCode >= 500:
+			log.Printf("[warn] %s %s returned %d, retrying", method, path, resp.StatusCode)
+			return fmt.Errorf("%s %s returned %d", method, path, resp.StatusCode)
+		}
+		res = cloudflareResponse{}
+		if err := json.Unmarshal(b, &res); err != nil {
+			return retry.MarkPermanent(errors.Wrapf(err, "failed to parse a response of %s %s (%d)", method, path, resp.StatusCode))
+		}
+		if !res.Success {
+			return retry.MarkPermanent(errors.Wrapf(res.error(), "%s %s returned %d", method, path, resp.StatusCode))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// retryAfter parses a value of Retry-After header in seconds.
+func retryAfter(v string) time.Duration {
+	sec, err := strconv.Atoi(v)
+	if err != nil || sec <= 0 {
+		return 0
+	}
+	if d := time.Duration(sec) * time.Second; d < cloudflareMaxRetryAfter {
+		return d
+	}
+	return cloudflareMaxRetryAfter
+}
+
+func (cf *cloudflareClient) itemsPath(c *CloudflareListConfig) string {
+	return fmt.Sprintf("/accounts/%s/rules/lists/%s/items", url.PathEscape(c.AccountID), url.PathEscape(c.ListID))
+}
+
+// listItems returns all items in the list by following cursors.
+func (cf *cloudflareClient) listItems(ctx context.Context, c *CloudflareListConfig) ([]cloudflareListItem, error) {
+	var items []cloudflareListItem
+	var cursor string
+	for {
+		path := cf.itemsPath(c)
+		if cursor != "" {
+			path += "?cursor=" + url.QueryEscape(cursor)
+		}
+		res, err := cf.do(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []cloudflareListItem
+		if err := json.Unmarshal(res.Result, &page); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse items of %s", c)
+		}
+		items = append(items, page...)
+		if cursor = res.ResultInfo.Cursors.After; cursor == "" {
+			break
+		}
+	}
+	log.Printf("[debug] %s items:%d", c, len(items))
+	return items, nil
+}
+
+// bulkOperation runs an asynchronous bulk operation for items and waits for the completion.
+func (cf *cloudflareClient) bulkOperation(ctx context.Context, c *CloudflareListConfig, method string, in interface{}) error {
+	res, err := cf.do(ctx, method, cf.itemsPath(c), in)
+	if err != nil {
+		return err
+	}
+	var op struct {
+		OperationID string `json:"operation_id"`
+	}
+	if err := json.Unmarshal(res.Result, &op); err != nil {
+		return errors.Wrapf(err, "failed to parse an operation of %s", c)
+	}
+	path := fmt.Sprintf("/accounts/%s/rules/lists/bulk_operations/%s", url.PathEscape(c.AccountID), url.PathEscape(op.OperationID))
+	return retryPolicy.Do(ctx, func() error {
+		res, err := cf.do(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return retry.MarkPermanent(err)
+		}
+		var status struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := json.Unmarshal(res.Result, &status); err != nil {
+			return retry.MarkPermanent(errors.Wrapf(err, "failed to parse the operation %s", op.OperationID))
+		}
+		switch status.Status {
+		case "completed":
+			return nil
+		case "failed":
+			return retry.MarkPermanent(fmt.Errorf("operation %s for %s failed: %s", op.OperationID, c, status.Error))
+		}
+		log.Printf("[debug] operation %s for %s is %s", op.OperationID, c, status.Status)
+		return fmt.Errorf("operation %s for %s is %s", op.OperationID, c, status.Status)
+	})
+}
+
+// cloudflareListIP returns the IP of the list item for the event.
+// IPv6 addresses are widened to /64 because longer prefixes are not allowed in IP lists.
+func cloudflareListIP(ev ipSetEvent) string {
+	if ev.v4 {
+		return ev.address
+	}
+	ip, ipnet, _ := net.ParseCIDR(ev.CIDR())
+	if ones, _ := ipnet.Mask.Size(); ones <= cloudflareIPv6PrefixLength {
+		return ipnet.String()
+	}
+	mask := net.CIDRMask(cloudflareIPv6PrefixLength, 128)
+	return fmt.Sprintf("%s/%d", ip.Mask(mask), cloudflareIPv6PrefixLength)
+}
+
+// updateCloudflare applies active allowances in the backend to IP lists.
+// Lists are recomputed from the backend because an IPv6 item may be shared by multiple allowances.
+func (s *streamer) updateCloudflare(ctx context.Context) error {
+	evs, err := s.activeEvents()
+	if err != nil {
+		return err
+	}
+	for _, c := range s.conf.CloudflareLists {
+		if _, err := s.reconcileCloudflareList(ctx, c, evs, s.conf.DryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileCloudflareList adds items for active events and removes other items managed by knockrd.
+func (s *streamer) reconcileCloudflareList(ctx context.Context, c *CloudflareListConfig, active []ipSetEvent, dryRun bool) (ReconcileDiff, error) {
+	target := c.String()
+	desired := mapset.NewSet()
+	comments := make(map[string]string, len(active))
+	expires := make(map[string]time.Time, len(active))
+	for _, ev := range active {
+		ip := cloudflareListIP(ev)
+		desired.Add(ip)
+		if ev.expires.After(expires[ip]) || comments[ip] == "" {
+			comments[ip] = securityGroupRuleDescription(ev)
+			expires[ip] = ev.expires
+		}
+	}
+
+	cf := newCloudflareClient(c)
+	items, err := cf.listItems(ctx, c)
+	if err != nil {
+		return ReconcileDiff{Target: target}, err
+	}
+	current, managed := mapset.NewSet(), mapset.NewSet()
+	ids := make(map[string]string, len(items))
+	for _, item := range items {
+		current.Add(item.IP)
+		ids[item.IP] = item.ID
+		if isManagedDescription(item.Comment) {
+			managed.Add(item.IP)
+		}
+	}
+	diff := ReconcileDiff{
+		Target: target,
+		Add:    sortedStrings(desired.Difference(current)),
+		Remove: sortedStrings(managed.Difference(desired)),
+	}
+	if diff.IsEmpty() {
+		log.Printf("[info] %s is up to date", target)
+		return diff, nil
+	}
+	log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+	if dryRun {
+		return diff, nil
+	}
+	if len(diff.Remove) > 0 {
+		var remove []cloudflareListItem
+		for _, ip := range diff.Remove {
+			remove = append(remove, cloudflareListItem{ID: ids[ip]})
+		}
+		in := map[string]interface{}{"items": remove}
+		if err := cf.bulkOperation(ctx, c, http.MethodDelete, in); err != nil {
+			return diff, errors.Wrapf(err, "failed to remove items from %s", target)
+		}
+		log.Printf("[info] removed %d items from %s", len(remove), target)
+	}
+	if len(diff.Add) > 0 {
+		var add []cloudflareListItem
+		for _, ip := range diff.Add {
+			add = append(add, cloudflareListItem{IP: ip, Comment: comments[ip]})
+		}
+		if err := cf.bulkOperation(ctx, c, http.MethodPost, add); err != nil {
+			return diff, errors.Wrapf(err, "failed to add items to %s", target)
+		}
+		log.Printf("[info] added %d items to %s", len(add), target)
+	}
+	return diff, nil
+}
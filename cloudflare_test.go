@@ -0,0 +1,156 @@
+package knockrd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+type cloudflareItem struct {
+	ID      string `json:"id,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// fakeCloudflare serves a subset of the IP lists API. Items are listed one by one with cursors.
+type fakeCloudflare struct {
+	mu          sync.Mutex
+	items       []cloudflareItem
+	rateLimited bool
+	requests    []string
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+	if !f.rateLimited {
+		f.rateLimited = true
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":971,"message":"Please wait and consider throttling your request speed"}]}`)
+		return
+	}
+	itemsPath := "/client/v4/accounts/acc/rules/lists/list1/items"
+	res := map[string]interface{}{"success": true, "errors": []interface{}{}}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == itemsPath:
+		i := 0
+		fmt.Sscanf(r.URL.Query().Get("cursor"), "c%d", &i)
+		var page []cloudflareItem
+		if i < len(f.items) {
+			page = append(page, f.items[i])
+		}
+		res["result"] = page
+		if i+1 < len(f.items) {
+			res["result_info"] = map[string]interface{}{
+				"cursors": map[string]string{"after": fmt.Sprintf("c%d", i+1)},
+			}
+		}
+	case r.Method == http.MethodPost && r.URL.Path == itemsPath:
+		var add []cloudflareItem
+		json.NewDecoder(r.Body).Decode(&add)
+		for _, item := range add {
+			item.ID = "id-" + item.IP
+			f.items = append(f.items, item)
+		}
+		res["result"] = map[string]string{"operation_id": "op1"}
+	case r.Method == http.MethodDelete && r.URL.Path == itemsPath:
+		var in struct {
+			Items []cloudflareItem `json:"items"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		for _, d := range in.Items {
+			for i, item := range f.items {
+				if item.ID == d.ID {
+					f.items = append(f.items[:i], f.items[i+1:]...)
+					break
+				}
+			}
+		}
+		res["result"] = map[string]string{"operation_id": "op2"}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/client/v4/accounts/acc/rules/lists/bulk_operations/"):
+		res["result"] = map[string]string{"status": "completed"}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		res = map[string]interface{}{"success": false, "errors": []interface{}{map[string]interface{}{"code": 7003, "message": "not found"}}}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func TestCloudflareList(t *testing.T) {
+	f := &fakeCloudflare{
+		items: []cloudflareItem{
+			{ID: "a", IP: "198.51.100.1", Comment: "knockrd identity:foo@example.com"},
+			{ID: "b", IP: "203.0.113.0/24", Comment: "office"},
+		},
+	}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		CloudflareLists: []*knockrd.CloudflareListConfig{
+			{AccountID: "acc", ListID: "list1", APIToken: "secret", Endpoint: ts.URL + "/client/v4"},
+		},
+	}
+	b := &listBackend{
+		items: []knockrd.Item{
+			{Key: "198.51.100.123", Identity: "bar@example.com", Expires: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC).Unix()},
+			{Key: "2001:db8::1", Expires: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC).Unix()},
+			// shares 2001:db8::/64 and expires later
+			{Key: "2001:db8::2", Expires: time.Date(2020, 5, 1, 1, 0, 0, 0, time.UTC).Unix()},
+		},
+	}
+	handler := knockrd.NewStreamHandlerWithBackend(conf, b, nil)
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []string
+	for _, item := range f.items {
+		items = append(items, item.IP+" "+item.Comment)
+	}
+	sort.Strings(items)
+	expected := []string{
+		"198.51.100.123 knockrd identity:bar@example.com expires:2020-05-01T00:00:00Z",
+		"2001:db8::/64 knockrd expires:2020-05-01T01:00:00Z",
+		"203.0.113.0/24 office",
+	}
+	if strings.Join(items, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected items %#v", items)
+	}
+	expectedRequests := []string{
+		"GET /client/v4/accounts/acc/rules/lists/list1/items", // rate limited
+		"GET /client/v4/accounts/acc/rules/lists/list1/items",
+		"GET /client/v4/accounts/acc/rules/lists/list1/items?cursor=c1",
+		"DELETE /client/v4/accounts/acc/rules/lists/list1/items",
+		"GET /client/v4/accounts/acc/rules/lists/bulk_operations/op2",
+		"POST /client/v4/accounts/acc/rules/lists/list1/items",
+		"GET /client/v4/accounts/acc/rules/lists/bulk_operations/op1",
+	}
+	if strings.Join(f.requests, "\n") != strings.Join(expectedRequests, "\n") {
+		t.Errorf("unexpected requests %#v", f.requests)
+	}
+}
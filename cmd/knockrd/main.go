@@ -20,12 +20,14 @@ var filter = &logutils.LevelFilter{
 }
 
 func main() {
-	var configFile, run string
-	var debug, showVersion bool
+	var configFile, run, eventFile string
+	var debug, dryRun, showVersion bool
 
 	flag.StringVar(&configFile, "config", "", "config file name")
 	flag.BoolVar(&debug, "debug", false, "enable debug log")
-	flag.StringVar(&run, "run", "http", "run mode. http or stream")
+	flag.StringVar(&run, "run", "http", "run mode. http, stream, reconcile or sweep")
+	flag.BoolVar(&dryRun, "dry-run", false, "dry run (reconcile and stream only show differences)")
+	flag.StringVar(&eventFile, "event", "", "DynamoDB stream event JSON file to handle by the stream handler")
 	flag.BoolVar(&showVersion, "version", false, "show version")
 	flag.VisitAll(func(f *flag.Flag) {
 		if s := os.Getenv(strings.ToUpper("KNOCKRD_" + f.Name)); s != "" {
@@ -33,6 +35,10 @@ func main() {
 		}
 	})
 	flag.Parse()
+	if flag.NArg() > 0 {
+		// knockrd [flags] reconcile
+		run = flag.Arg(0)
+	}
 
 	if showVersion {
 		fmt.Println("knockrd version", version)
@@ -48,10 +54,15 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	switch run {
-	case "http", "stream":
-	default:
-		log.Fatalf("invalid run mode %s", run)
+	if dryRun {
+		cfg.DryRun = true
+	}
+	if eventFile != "" {
+		err = knockrd.RunStreamEvent(cfg, eventFile)
+	} else {
+		err = knockrd.RunMode(cfg, run)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-	log.Fatal(knockrd.Run(cfg, run == "stream"))
 }
@@ -3,14 +3,17 @@ package knockrd
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/fujiwara/go-amzn-oidc/validator"
 	"github.com/kayac/go-config"
 	"github.com/natureglobal/realip"
@@ -21,6 +24,25 @@ const (
 	DefaultTable    = "knockrd"
 	DefaultTTL      = time.Hour
 	DefaultCacheTTL = 10 * time.Second
+
+	BackendDynamoDB = "dynamodb"
+	BackendMemory   = "memory"
+
+	DefaultHAProxyMapValue = "1"
+	DefaultHAProxyTimeout  = 5 * time.Second
+	DefaultWebhookTimeout  = 10 * time.Second
+	DefaultSweepInterval   = time.Minute
+	DefaultEtcdTimeout     = 5 * time.Second
+
+	DefaultIPSetMaxEntries       = 10000
+	DefaultSecurityGroupMaxRules = 60
+	DefaultCapacityWarningRatio  = 0.8
+
+	EvictionNone   = "none"
+	EvictionOldest = "oldest"
+
+	MinWideningIPv4PrefixLength = 16
+	MinWideningIPv6PrefixLength = 48
 )
 
 var DefaultRealIPFrom = []string{
@@ -36,22 +58,43 @@ type Config struct {
 	Port          int    `yaml:"port"`
 	ProxyProtocol bool   `yaml:"proxy_protocol"`
 	TableName     string `yaml:"table_name"`
+	DryRun        bool   `yaml:"dry_run"`
+	Backend       string `yaml:"backend"`    // dynamodb (default) or memory
+	InProcess     bool   `yaml:"in_process"` // apply changes to targets in the http process
 
 	RealIPFrom           []string `yaml:"real_ip_from"`
 	RealIPFromCloudFront bool     `yaml:"real_ip_from_cloudfront"`
 	RealIPHeader         string   `yaml:"real_ip_header"`
 
 	OIDCAllowed *ConfigOIDCAllowed `yaml:"oidc_allowed"`
+	Widening    WideningPolicies   `yaml:"widening"`
 
-	TTL      time.Duration `yaml:"ttl"`
-	CacheTTL time.Duration `yaml:"cache_ttl"`
-	AWS      AWSConfig     `yaml:"aws"`
-	IPSet    *struct {
+	TTL         time.Duration   `yaml:"ttl"`
+	TTLChoices  []time.Duration `yaml:"ttl_choices"`  // durations shown in the /allow form
+	TTLPolicies TTLPolicies     `yaml:"ttl_policies"` // max durations for identities
+	MaxSession  time.Duration   `yaml:"max_session"`  // max total length of an allowance extended by users (0 means unlimited)
+	CacheTTL    time.Duration   `yaml:"cache_ttl"`
+	AWS         AWSConfig       `yaml:"aws"`
+	IPSet       *struct {
 		V4 *IPSetConfig `yaml:"v4"`
 		V6 *IPSetConfig `yaml:"v6"`
-	} `yaml:"ip-set"`
-	Consul         *ConsulConfig          `yaml:"consul"`
-	SecurityGroups []*SecurityGroupConfig `yaml:"security_groups"`
+	} `yaml:"ip-set"` // deprecated. use IPSets
+	IPSets          IPSetsConfig            `yaml:"ip_sets"`
+	Consul          *ConsulConfig           `yaml:"consul"`
+	SecurityGroups  []*SecurityGroupConfig  `yaml:"security_groups"`
+	Capacity        CapacityConfig          `yaml:"capacity"`
+	PrefixLists     PrefixListsConfig       `yaml:"prefix_lists"`
+	NetworkACLs     []*NetworkACLConfig     `yaml:"network_acls"`
+	Firewall        *FirewallConfig         `yaml:"firewall"`
+	AllowFiles      []*AllowFileConfig      `yaml:"allow_files"`
+	HAProxy         []*HAProxyConfig        `yaml:"haproxy"`
+	Kubernetes      *KubernetesConfig       `yaml:"kubernetes"`
+	CloudflareLists []*CloudflareListConfig `yaml:"cloudflare_lists"`
+	Webhooks        []*WebhookConfig        `yaml:"webhooks"`
+	Etcd            *EtcdConfig             `yaml:"etcd"`
+	Stream          StreamConfig            `yaml:"stream"`
+	Sweeper         SweeperConfig           `yaml:"sweeper"`
+	Services        []*ServiceConfig        `yaml:"services"`
 }
 
 type ConsulConfig struct {
@@ -59,6 +102,11 @@ type ConsulConfig struct {
 	Scheme     string `yaml:"scheme"`
 	Datacenter string `yaml:"datacenter"`
 	KVPath     string `yaml:"kv_path"`
+	Token      string `yaml:"token" json:"-"`
+	Namespace  string `yaml:"namespace"` // Consul Enterprise only
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
 }
 
 type AWSConfig struct {
@@ -66,19 +114,200 @@ type AWSConfig struct {
 	Endpoint string `yaml:"endpoint"`
 }
 
+// IPSetsConfig represents WAFv2 IP sets for each address family
+type IPSetsConfig struct {
+	V4 []*IPSetConfig `yaml:"v4"`
+	V6 []*IPSetConfig `yaml:"v6"`
+}
+
 type IPSetConfig struct {
-	ID    string `yaml:"id"`
-	Scope string `yaml:"scope"`
-	Name  string `yaml:"name"`
+	ID     string `yaml:"id"`
+	Scope  string `yaml:"scope"`
+	Name   string `yaml:"name"`
+	Region string `yaml:"region"`
+
+	MaxEntries int            `yaml:"max_entries"` // default 10000
+	Spillover  []*IPSetConfig `yaml:"spillover"`   // IP sets used when the set is full
+}
+
+func (c *IPSetConfig) String() string {
+	return fmt.Sprintf("ip-set id:%s name:%s scope:%s region:%s", c.ID, c.Name, c.Scope, c.Region)
 }
 
 type SecurityGroupConfig struct {
-	ID       string `yaml:"id"`
+	ID       string        `yaml:"id"`
+	FromPort int64         `yaml:"from_port"`
+	ToPort   int64         `yaml:"to_port"`
+	Protocol string        `yaml:"protocol"`
+	Ports    []*PortConfig `yaml:"ports"`
+
+	MaxRules  int      `yaml:"max_rules"` // inbound rules for each address family. default 60
+	Spillover []string `yaml:"spillover"` // IDs of security groups used when the group is full
+}
+
+// CapacityConfig represents the policy for targets which have limits of entries.
+type CapacityConfig struct {
+	Eviction     string  `yaml:"eviction"`      // none (default) or oldest
+	WarningRatio float64 `yaml:"warning_ratio"` // default 0.8
+}
+
+type PortConfig struct {
 	FromPort int64  `yaml:"from_port"`
 	ToPort   int64  `yaml:"to_port"`
 	Protocol string `yaml:"protocol"`
 }
 
+// PrefixListsConfig represents EC2 managed prefix lists for each address family
+type PrefixListsConfig struct {
+	V4 []*PrefixListConfig `yaml:"v4"`
+	V6 []*PrefixListConfig `yaml:"v6"`
+}
+
+type PrefixListConfig struct {
+	ID string `yaml:"id"`
+}
+
+func (c *PrefixListConfig) String() string {
+	return fmt.Sprintf("prefix-list id:%s", c.ID)
+}
+
+// NetworkACLConfig represents ingress allow entries in a network ACL managed by knockrd.
+// Rule numbers of entries are allocated from RuleNumberFrom to RuleNumberTo.
+type NetworkACLConfig struct {
+	ID             string `yaml:"id"`
+	RuleNumberFrom int64  `yaml:"rule_number_from"`
+	RuleNumberTo   int64  `yaml:"rule_number_to"`
+	FromPort       int64  `yaml:"from_port"`
+	ToPort         int64  `yaml:"to_port"`
+	Protocol       string `yaml:"protocol"`
+}
+
+func (c *NetworkACLConfig) String() string {
+	return fmt.Sprintf("network-acl id:%s rules:%d-%d %s %d-%d", c.ID, c.RuleNumberFrom, c.RuleNumberTo, c.Protocol, c.FromPort, c.ToPort)
+}
+
+// FirewallConfig represents sets of the local host firewall (nftables or ipset).
+// The sets must support timeouts of elements.
+type FirewallConfig struct {
+	Type   string `yaml:"type"`   // nftables or ipset
+	Family string `yaml:"family"` // nftables only (default inet)
+	Table  string `yaml:"table"`  // nftables only
+	SetV4  string `yaml:"set_v4"`
+	SetV6  string `yaml:"set_v6"`
+}
+
+// AllowFileConfig represents a file rendered from allowed addresses (e.g. nginx allow directives).
+type AllowFileConfig struct {
+	Path          string        `yaml:"path"`
+	Format        string        `yaml:"format"`   // nginx, nginx-geo, haproxy or apache
+	Template      string        `yaml:"template"` // text/template. overrides format
+	Mode          uint32        `yaml:"mode"`
+	ReloadCommand string        `yaml:"reload_command"`
+	ReloadDelay   time.Duration `yaml:"reload_delay"`
+}
+
+// HAProxyConfig represents an ACL or a map of HAProxy updated by the Runtime API.
+type HAProxyConfig struct {
+	Address  string        `yaml:"address"`   // path of the unix socket or host:port of the Runtime API
+	ACL      string        `yaml:"acl"`       // ACL file name or #<id>
+	Map      string        `yaml:"map"`       // map file name or #<id>
+	MapValue string        `yaml:"map_value"` // value of map entries (default "1")
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+func (c *HAProxyConfig) String() string {
+	if c.Map != "" {
+		return fmt.Sprintf("haproxy address:%s map:%s", c.Address, c.Map)
+	}
+	return fmt.Sprintf("haproxy address:%s acl:%s", c.Address, c.ACL)
+}
+
+// KubernetesConfig represents Kubernetes objects which allow addresses.
+// When APIServer is empty, the in-cluster API server and the service account are used.
+type KubernetesConfig struct {
+	APIServer       string                           `yaml:"api_server"`
+	TokenFile       string                           `yaml:"token_file"`
+	CAFile          string                           `yaml:"ca_file"`
+	Ingresses       []*KubernetesIngressConfig       `yaml:"ingresses"`
+	NetworkPolicies []*KubernetesNetworkPolicyConfig `yaml:"network_policies"`
+}
+
+// KubernetesIngressConfig represents an Ingress whose annotation has allowed CIDRs.
+type KubernetesIngressConfig struct {
+	Namespace   string   `yaml:"namespace"`
+	Name        string   `yaml:"name"`
+	Annotation  string   `yaml:"annotation"` // default nginx.ingress.kubernetes.io/whitelist-source-range
+	StaticCIDRs []string `yaml:"static_cidrs"`
+}
+
+func (c *KubernetesIngressConfig) String() string {
+	return fmt.Sprintf("ingress %s/%s", c.Namespace, c.Name)
+}
+
+// KubernetesNetworkPolicyConfig represents an ingress rule of a NetworkPolicy whose ipBlock peers are allowed CIDRs.
+type KubernetesNetworkPolicyConfig struct {
+	Namespace   string   `yaml:"namespace"`
+	Name        string   `yaml:"name"`
+	RuleIndex   int      `yaml:"rule_index"` // index of spec.ingress
+	StaticCIDRs []string `yaml:"static_cidrs"`
+}
+
+func (c *KubernetesNetworkPolicyConfig) String() string {
+	return fmt.Sprintf("networkpolicy %s/%s ingress[%d]", c.Namespace, c.Name, c.RuleIndex)
+}
+
+// CloudflareListConfig represents an IP list of a Cloudflare account.
+type CloudflareListConfig struct {
+	AccountID string `yaml:"account_id"`
+	ListID    string `yaml:"list_id"`
+	APIToken  string `yaml:"api_token" json:"-"` // default $CLOUDFLARE_API_TOKEN
+	Endpoint  string `yaml:"endpoint"`
+}
+
+func (c *CloudflareListConfig) String() string {
+	return fmt.Sprintf("cloudflare-list account:%s id:%s", c.AccountID, c.ListID)
+}
+
+// StreamConfig represents the stream consumer running without AWS Lambda.
+type StreamConfig struct {
+	StreamARN       string        `yaml:"stream_arn"` // default the latest stream of the table
+	CheckpointFile  string        `yaml:"checkpoint_file"`
+	CheckpointTable string        `yaml:"checkpoint_table"`
+	PollInterval    time.Duration `yaml:"poll_interval"`
+	MaxRetries      int           `yaml:"max_retries"` // default DefaultStreamMaxRetries, -1 means infinite
+
+	// ReportBatchItemFailures makes the function return failed records instead of an error.
+	// FunctionResponseTypes of the event source mapping must include ReportBatchItemFailures.
+	ReportBatchItemFailures bool `yaml:"report_batch_item_failures"`
+}
+
+// SweeperConfig represents the sweeper of expired items.
+type SweeperConfig struct {
+	Interval  time.Duration `yaml:"interval"`
+	InProcess bool          `yaml:"in_process"` // run the sweeper in the http process
+}
+
+// EtcdConfig represents etcd (v3.4 or later) accessed by the JSON gateway.
+type EtcdConfig struct {
+	Endpoints []string      `yaml:"endpoints"` // e.g. http://127.0.0.1:2379
+	Username  string        `yaml:"username"`
+	Password  string        `yaml:"password" json:"-"`
+	KeyPrefix string        `yaml:"key_prefix"` // default knockrd/allowed
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// WebhookConfig represents an endpoint which receives events by signed requests.
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Secret  string            `yaml:"secret" json:"-"` // key of HMAC-SHA256 signatures
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+func (c *WebhookConfig) String() string {
+	return fmt.Sprintf("webhook url:%s", c.URL)
+}
+
 type ConfigOIDCAllowed struct {
 	EmailDomains   []string `yaml:"email_domains"`
 	EmailAddresses []string `yaml:"email_addresses"`
@@ -106,6 +335,52 @@ func (c *ConfigOIDCAllowed) allow(email string) bool {
 	return false
 }
 
+// WideningPolicy widens allowances of matched identities to networks which contain the addresses.
+type WideningPolicy struct {
+	Identities       []string `yaml:"identities"` // "*" matches any identity including anonymous users
+	EmailDomains     []string `yaml:"email_domains"`
+	IPv4PrefixLength int      `yaml:"ipv4_prefix_length"` // default 32 (not widened)
+	IPv6PrefixLength int      `yaml:"ipv6_prefix_length"` // default 128 (not widened)
+}
+
+func (p *WideningPolicy) match(identity string) bool {
+	return matchIdentity(identity, p.Identities, p.EmailDomains)
+}
+
+// TTLPolicy limits durations of allowances for matched identities.
+type TTLPolicy struct {
+	Identities   []string      `yaml:"identities"` // "*" matches any identity including anonymous users
+	EmailDomains []string      `yaml:"email_domains"`
+	MaxTTL       time.Duration `yaml:"max_ttl"`
+}
+
+func (p *TTLPolicy) match(identity string) bool {
+	return matchIdentity(identity, p.Identities, p.EmailDomains)
+}
+
+// matchIdentity returns whether the identity is included in the identities or the email domains.
+func matchIdentity(identity string, identities, emailDomains []string) bool {
+	identity = strings.ToLower(identity)
+	for _, id := range identities {
+		if id == "*" || (identity != "" && identity == strings.ToLower(id)) {
+			return true
+		}
+	}
+	if identity == "" {
+		return false
+	}
+	for _, d := range emailDomains {
+		domain := strings.ToLower(d)
+		if !strings.HasPrefix(domain, "@") {
+			domain = "@" + domain
+		}
+		if strings.HasSuffix(identity, domain) {
+			return true
+		}
+	}
+	return false
+}
+
 func LoadConfig(path string) (*Config, error) {
 	log.Println("[info] loading config file", path)
 	c := Config{
@@ -127,6 +402,63 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	switch c.Capacity.Eviction {
+	case "", EvictionNone, EvictionOldest:
+	default:
+		return nil, fmt.Errorf("invalid capacity.eviction %s: Set none or oldest", c.Capacity.Eviction)
+	}
+	if r := c.Capacity.WarningRatio; r < 0 || r > 1 {
+		return nil, fmt.Errorf("invalid capacity.warning_ratio %g: Set 0 to 1", r)
+	}
+
+	for i, p := range c.Widening {
+		if len(p.Identities) == 0 && len(p.EmailDomains) == 0 {
+			return nil, fmt.Errorf("widening[%d]: identities or email_domains is required", i)
+		}
+		if p.IPv4PrefixLength == 0 {
+			p.IPv4PrefixLength = 32
+		}
+		if p.IPv6PrefixLength == 0 {
+			p.IPv6PrefixLength = 128
+		}
+		if p.IPv4PrefixLength < MinWideningIPv4PrefixLength || p.IPv4PrefixLength > 32 {
+			return nil, fmt.Errorf("widening[%d]: invalid ipv4_prefix_length %d: Set %d to 32", i, p.IPv4PrefixLength, MinWideningIPv4PrefixLength)
+		}
+		if p.IPv6PrefixLength < MinWideningIPv6PrefixLength || p.IPv6PrefixLength > 128 {
+			return nil, fmt.Errorf("widening[%d]: invalid ipv6_prefix_length %d: Set %d to 128", i, p.IPv6PrefixLength, MinWideningIPv6PrefixLength)
+		}
+	}
+
+	for _, d := range c.TTLChoices {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid ttl_choices %s", d)
+		}
+	}
+	if c.MaxSession < 0 {
+		return nil, fmt.Errorf("invalid max_session %s", c.MaxSession)
+	}
+	for i, p := range c.TTLPolicies {
+		if len(p.Identities) == 0 && len(p.EmailDomains) == 0 {
+			return nil, fmt.Errorf("ttl_policies[%d]: identities or email_domains is required", i)
+		}
+		if p.MaxTTL <= 0 {
+			return nil, fmt.Errorf("ttl_policies[%d]: max_ttl is required", i)
+		}
+	}
+
+	switch c.Backend {
+	case "", BackendDynamoDB, BackendMemory:
+	default:
+		return nil, fmt.Errorf("invalid backend %s: Set dynamodb or memory", c.Backend)
+	}
+
+	if err := c.validateTargets(); err != nil {
+		return nil, err
+	}
+	if err := c.validateServices(); err != nil {
+		return nil, err
+	}
+
 	if c.RealIPFromCloudFront {
 		cirds, err := fetchCloudFrontCIRDs()
 		if err != nil {
@@ -138,6 +470,132 @@ func LoadConfig(path string) (*Config, error) {
 	return &c, nil
 }
 
+// validateTargets validates configurations of targets and sets default values.
+func (c *Config) validateTargets() error {
+	if c.IPSet != nil {
+		// merge deprecated ip-set into ip_sets
+		if c.IPSet.V4 != nil {
+			c.IPSets.V4 = append([]*IPSetConfig{c.IPSet.V4}, c.IPSets.V4...)
+		}
+		if c.IPSet.V6 != nil {
+			c.IPSets.V6 = append([]*IPSetConfig{c.IPSet.V6}, c.IPSets.V6...)
+		}
+		c.IPSet = nil
+	}
+	var ipsets []*IPSetConfig
+	for _, ipset := range append(c.IPSets.V4, c.IPSets.V6...) {
+		ipsets = append(ipsets, ipset)
+		for _, sp := range ipset.Spillover {
+			if len(sp.Spillover) > 0 {
+				return fmt.Errorf("spillover of spillover IP set %s is not supported", sp.ID)
+			}
+			if sp.Scope == "" {
+				sp.Scope = ipset.Scope
+			}
+			if sp.Region == "" {
+				sp.Region = ipset.Region
+			}
+			ipsets = append(ipsets, sp)
+		}
+	}
+	for _, ipset := range ipsets {
+		if ipset.ID == "" {
+			// not configured. skipped by the stream and reconciliation
+			continue
+		}
+		switch ipset.Scope {
+		case "CLOUDFRONT":
+			ipset.Region = "us-east-1" // for CloudFront
+		case "REGIONAL":
+			if ipset.Region == "" {
+				ipset.Region = c.AWS.Region
+			}
+		default:
+			return fmt.Errorf("invalid scope %s for %s: Set REGIONAL or CLOUDFRONT", ipset.Scope, ipset.ID)
+		}
+	}
+
+	for _, acl := range c.NetworkACLs {
+		if acl.RuleNumberFrom <= 0 || acl.RuleNumberTo < acl.RuleNumberFrom || acl.RuleNumberTo > 32766 {
+			return fmt.Errorf("invalid rule number range %d-%d for %s", acl.RuleNumberFrom, acl.RuleNumberTo, acl.ID)
+		}
+	}
+
+	if fw := c.Firewall; fw != nil {
+		switch fw.Type {
+		case FirewallTypeNftables:
+			if fw.Table == "" {
+				return fmt.Errorf("firewall.table is required for nftables")
+			}
+		case FirewallTypeIPSet:
+		default:
+			return fmt.Errorf("invalid firewall.type %s: Set nftables or ipset", fw.Type)
+		}
+	}
+
+	for _, af := range c.AllowFiles {
+		if af.Path == "" {
+			return fmt.Errorf("allow_files.path is required")
+		}
+		if _, err := newAllowFileWriter(af, nil); err != nil {
+			return err
+		}
+	}
+
+	for _, hc := range c.HAProxy {
+		if hc.Address == "" {
+			return fmt.Errorf("haproxy.address is required")
+		}
+		if (hc.ACL == "") == (hc.Map == "") {
+			return fmt.Errorf("either haproxy.acl or haproxy.map is required for %s", hc.Address)
+		}
+	}
+
+	if kc := c.Kubernetes; kc != nil {
+		for _, ing := range kc.Ingresses {
+			if ing.Namespace == "" || ing.Name == "" {
+				return fmt.Errorf("kubernetes.ingresses requires namespace and name")
+			}
+		}
+		for _, np := range kc.NetworkPolicies {
+			if np.Namespace == "" || np.Name == "" {
+				return fmt.Errorf("kubernetes.network_policies requires namespace and name")
+			}
+			if np.RuleIndex < 0 {
+				return fmt.Errorf("invalid rule_index %d for %s", np.RuleIndex, np)
+			}
+		}
+	}
+
+	for _, cl := range c.CloudflareLists {
+		if cl.AccountID == "" || cl.ListID == "" {
+			return fmt.Errorf("cloudflare_lists requires account_id and list_id")
+		}
+		if cl.APIToken == "" {
+			cl.APIToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+		}
+		if cl.APIToken == "" {
+			return fmt.Errorf("api_token or CLOUDFLARE_API_TOKEN is required for %s", cl)
+		}
+	}
+
+	if ec := c.Etcd; ec != nil {
+		if len(ec.Endpoints) == 0 {
+			return fmt.Errorf("etcd.endpoints is required")
+		}
+	}
+
+	for _, wc := range c.Webhooks {
+		if u, err := url.Parse(wc.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid webhooks.url %s", wc.URL)
+		}
+		if wc.Secret == "" {
+			return fmt.Errorf("webhooks.secret is required for %s", wc.URL)
+		}
+	}
+	return nil
+}
+
 func (c *Config) String() string {
 	b, _ := json.Marshal(c)
 	return string(b)
@@ -146,7 +604,7 @@ func (c *Config) String() string {
 // Setup setups resources by config
 func (c *Config) Setup() (http.Handler, func(context.Context, events.DynamoDBEvent) error, error) {
 	log.Println("[info] setup")
-	onLambda := strings.HasPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda_") || os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+	onLambda := isOnLambda()
 	if onLambda {
 		// Allows RemoteAddr set by lambdaHandler.ServeHTTP()
 		c.RealIPFrom = append(c.RealIPFrom, "127.0.0.1/32")
@@ -171,12 +629,31 @@ func (c *Config) Setup() (http.Handler, func(context.Context, events.DynamoDBEve
 		hh = lambdaHandler{hh}
 	}
 
-	sh := NewStreamHandler(c)
-
-	b, err := NewDynamoDBBackend(c)
+	var b Backend
+	switch c.Backend {
+	case BackendMemory:
+		b, err = NewMemoryBackend(c)
+	default:
+		b, err = NewDynamoDBBackend(c)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	s := newStreamer(c)
+	s.backend = b
+	backend = b
+	widening = c.Widening
+	ttlChoices = c.TTLChoices
+	ttlPolicies = c.TTLPolicies
+	maxSession = c.MaxSession
+	services = c.Services
+	if c.InProcess {
+		log.Println("[info] changes are applied to targets in the process")
+		backend = newInProcessBackend(context.Background(), b, s)
+	}
+	if db, ok := b.(*DynamoDBBackend); ok && c.Sweeper.InProcess {
+		go newSweeper(db, c.Sweeper.Interval).run(context.Background())
+	}
 	if c.CacheTTL > 0 {
 		if c.CacheTTL > c.TTL {
 			log.Printf(
@@ -187,12 +664,26 @@ func (c *Config) Setup() (http.Handler, func(context.Context, events.DynamoDBEve
 			c.CacheTTL = c.TTL
 		}
 		var err error
-		backend, err = NewCachedBackend(b, c.CacheTTL)
+		backend, err = NewCachedBackend(backend, c.CacheTTL)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
-	return hh, sh, err
+	return hh, s.Handler, err
+}
+
+func (c *Config) awsConfig(region string) *aws.Config {
+	cfg := &aws.Config{
+		Region: aws.String(region),
+	}
+	if c.AWS.Endpoint != "" {
+		cfg.Endpoint = aws.String(c.AWS.Endpoint)
+	}
+	return cfg
+}
+
+func isOnLambda() bool {
+	return strings.HasPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda_") || os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
 }
 
 func (c *Config) createRealIPMiddleware() (func(http.Handler) http.Handler, error) {
@@ -216,17 +707,17 @@ func (c *Config) createAmznOIDCDataValidator() allowFunc {
 	if c.OIDCAllowed == nil {
 		return nil
 	}
-	return func(r *http.Request) (bool, error) {
+	return func(r *http.Request) (string, bool, error) {
 		claims, err := validator.Validate(r.Header.Get("x-amzn-oidc-data"))
 		if err != nil {
 			log.Println("[warn] x-amzn-oidc-data validate failed", err)
-			return false, err
+			return "", false, err
 		}
 		email := claims.Email()
 		if email == "" {
 			log.Println("[warn] x-amzn-oidc-data claims have not a email")
-			return false, nil
+			return "", false, nil
 		}
-		return c.OIDCAllowed.allow(email), nil
+		return email, c.OIDCAllowed.allow(email), nil
 	}
 }
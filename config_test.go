@@ -0,0 +1,85 @@
+package knockrd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fujiwara/knockrd"
+)
+
+func TestLoadConfigIPSets(t *testing.T) {
+	c, err := knockrd.LoadConfig("test/config_ipsets.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedV4 := []string{
+		"ip-set id:legacy-v4 name:legacy-v4 scope:REGIONAL region:ap-northeast-1",
+		"ip-set id:cf-v4 name:cf-v4 scope:CLOUDFRONT region:us-east-1",
+		"ip-set id:regional-v4 name:regional-v4 scope:REGIONAL region:us-west-2",
+	}
+	if len(c.IPSets.V4) != len(expectedV4) {
+		t.Fatalf("unexpected v4 ip sets %d", len(c.IPSets.V4))
+	}
+	for i, s := range expectedV4 {
+		if c.IPSets.V4[i].String() != s {
+			t.Errorf("unexpected v4 ip set %s", c.IPSets.V4[i])
+		}
+	}
+	if len(c.IPSets.V6) != 1 || c.IPSets.V6[0].Region != "us-east-1" {
+		t.Errorf("unexpected v6 ip sets %v", c.IPSets.V6)
+	}
+	if c.IPSet != nil {
+		t.Error("deprecated ip-set must be merged into ip_sets")
+	}
+}
+
+func TestLoadConfigIPSetsWithoutID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for yaml, valid := range map[string]bool{
+		// entries without ID are skipped
+		"ip-set:\n  v4:\n    id: v4\n    name: v4\n    scope: REGIONAL\n  v6:\n    name: v6\n": true,
+		"ip_sets:\n  v4:\n    - id: \"\"\n      scope: \"\"\n":                                 true,
+		"ip_sets:\n  v4:\n    - id: v4\n      name: v4\n":                                      false,
+		"ip_sets:\n  v4:\n    - id: v4\n      name: v4\n      scope: GLOBAL\n":                 false,
+	} {
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := knockrd.LoadConfig(path)
+		if valid && err != nil {
+			t.Errorf("unexpected error %s for %s", err, yaml)
+		} else if !valid && err == nil {
+			t.Errorf("expected an error for %s", yaml)
+		}
+	}
+}
+
+func TestConfigStringHidesSecrets(t *testing.T) {
+	for secret, conf := range map[string]*knockrd.Config{
+		"cloudflare-token": {
+			CloudflareLists: []*knockrd.CloudflareListConfig{{AccountID: "a", ListID: "l", APIToken: "cloudflare-token"}},
+		},
+		"webhook-secret": {
+			Webhooks: []*knockrd.WebhookConfig{{URL: "https://example.com/hook", Secret: "webhook-secret"}},
+		},
+		"etcd-password": {
+			Etcd: &knockrd.EtcdConfig{Username: "knockrd", Password: "etcd-password"},
+		},
+		"consul-token": {
+			Consul: &knockrd.ConsulConfig{Address: "127.0.0.1:8500", Token: "consul-token"},
+		},
+	} {
+		s := conf.String()
+		if strings.Contains(s, secret) {
+			t.Errorf("%s is shown in %s", secret, s)
+		}
+	}
+}
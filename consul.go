@@ -0,0 +1,109 @@
+package knockrd
+
+import (
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+var DefaultConsulKVPath = "knockrd/allowed"
+
+// maxConsulTxnOps is the max number of operations in a transaction of Consul.
+const maxConsulTxnOps = 64
+
+func (s *streamer) consulClient(c *ConsulConfig) (*consul.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.consul != nil {
+		return s.consul, nil
+	}
+	// empty fields are filled by defaults and environment variables (e.g. CONSUL_HTTP_TOKEN) in NewClient
+	client, err := consul.NewClient(&consul.Config{
+		Address:    c.Address,
+		Scheme:     c.Scheme,
+		Datacenter: c.Datacenter,
+		Token:      c.Token,
+		Namespace:  c.Namespace,
+		TLSConfig: consul.TLSConfig{
+			CAFile:   c.CAFile,
+			CertFile: c.CertFile,
+			KeyFile:  c.KeyFile,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new consul client")
+	}
+	s.consul = client
+	return client, nil
+}
+
+// updateConsulKV applies events to Consul KV by transactions.
+// Each transaction has up to 64 operations, so a batch over 64 operations is not atomic.
+// It is applied by multiple transactions, and transactions committed before a failure are not rolled back.
+func (s *streamer) updateConsulKV(c *ConsulConfig, events ...[]ipSetEvent) error {
+	evs := latestEvents(events...)
+	if len(evs) == 0 {
+		return nil
+	}
+	client, err := s.consulClient(c)
+	if err != nil {
+		return err
+	}
+	kvPath := c.KVPath
+	if kvPath == "" {
+		kvPath = DefaultConsulKVPath
+	}
+	var ops consul.KVTxnOps
+	for _, ev := range evs {
+		key := path.Join(kvPath, url.PathEscape(ev.address))
+		if ev.add {
+			if s.skipByDryRun("put to consul key=%s value=%s", key, ev.CIDR()) {
+				continue
+			}
+			log.Printf("[info] put to consul key=%s", key)
+			ops = append(ops, &consul.KVTxnOp{
+				Verb:  consul.KVSet,
+				Key:   key,
+				Value: []byte(ev.CIDR()),
+			})
+		} else {
+			if s.skipByDryRun("delete from consul key=%s", key) {
+				continue
+			}
+			log.Printf("[info] delete from consul key=%s", key)
+			ops = append(ops, &consul.KVTxnOp{
+				Verb: consul.KVDelete,
+				Key:  key,
+			})
+		}
+	}
+	kv := client.KV()
+	total, txns := len(ops), 0
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxConsulTxnOps {
+			n = maxConsulTxnOps
+		}
+		ok, res, _, err := kv.Txn(ops[:n], nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to run a transaction of consul")
+		}
+		if !ok {
+			var msgs []string
+			for _, e := range res.Errors {
+				msgs = append(msgs, e.What)
+			}
+			return errors.Errorf("transaction of consul is rolled back: %s", strings.Join(msgs, ", "))
+		}
+		ops = ops[n:]
+		txns++
+	}
+	if txns > 0 {
+		log.Printf("[debug] committed %d transactions of consul ops:%d", txns, total)
+	}
+	return nil
+}
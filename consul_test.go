@@ -0,0 +1,129 @@
+package knockrd_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+func TestConsulTxn(t *testing.T) {
+	var mu sync.Mutex
+	var txns [][]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPut || r.URL.Path != "/v1/txn" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Consul-Token") != "token1" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		if ns := r.URL.Query().Get("ns"); ns != "team1" {
+			t.Errorf("unexpected namespace %s", ns)
+		}
+		var in []struct {
+			KV struct {
+				Verb  string
+				Key   string
+				Value string
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		var ops []string
+		for _, op := range in {
+			v, _ := base64.StdEncoding.DecodeString(op.KV.Value)
+			ops = append(ops, strings.TrimSpace(fmt.Sprintf("%s %s %s", op.KV.Verb, op.KV.Key, v)))
+		}
+		txns = append(txns, ops)
+		fmt.Fprint(w, `{"Results":[],"Errors":null}`)
+	}))
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Consul: &knockrd.ConsulConfig{
+			Address:   strings.TrimPrefix(ts.URL, "http://"),
+			Scheme:    "http",
+			Token:     "token1",
+			Namespace: "team1",
+		},
+	}
+	handler := knockrd.NewStreamHandler(conf)
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := handler(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := strings.Join([]string{
+		"delete knockrd/allowed/198.51.100.1",
+		"set knockrd/allowed/198.51.100.123 198.51.100.123/32",
+		"set knockrd/allowed/2001:db8::1 2001:db8::1/128",
+	}, "\n")
+	// a transaction for each invocation
+	if len(txns) != 2 {
+		t.Fatalf("unexpected transactions %#v", txns)
+	}
+	for _, ops := range txns {
+		if strings.Join(ops, "\n") != expected {
+			t.Errorf("unexpected operations %#v", ops)
+		}
+	}
+}
+
+func TestConsulDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	}))
+	defer ts.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	conf := &knockrd.Config{
+		TTL:    time.Hour,
+		DryRun: true,
+		Consul: &knockrd.ConsulConfig{
+			Address: strings.TrimPrefix(ts.URL, "http://"),
+			Scheme:  "http",
+		},
+	}
+	handler := knockrd.NewStreamHandler(conf)
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{
+		"[info] (dry-run) delete from consul key=knockrd/allowed/198.51.100.1\n",
+		"[info] (dry-run) put to consul key=knockrd/allowed/198.51.100.123 value=198.51.100.123/32\n",
+		"[info] (dry-run) put to consul key=knockrd/allowed/2001:db8::1 value=2001:db8::1/128\n",
+	} {
+		if !strings.Contains(logs.String(), op) {
+			t.Errorf("%q is not logged", op)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package knockrd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultEtcdKeyPrefix is the default prefix of keys in etcd.
+var DefaultEtcdKeyPrefix = "knockrd/allowed"
+
+// etcdClient calls etcd v3 API by the JSON gateway.
+type etcdClient struct {
+	conf   *EtcdConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+// errEtcdUnauthenticated is returned when etcd rejects the auth token (e.g. expired).
+var errEtcdUnauthenticated = errors.New("auth token is rejected by etcd")
+
+// etcdInt64 is an int64 encoded as a string (or a number) in JSON of the gateway.
+type etcdInt64 string
+
+func (i *etcdInt64) UnmarshalJSON(b []byte) error {
+	*i = etcdInt64(strings.Trim(string(b), `"`))
+	return nil
+}
+
+// etcdKeyValue is a key-value of the gateway.
+type etcdKeyValue struct {
+	Key   string    `json:"key"`
+	Lease etcdInt64 `json:"lease"`
+}
+
+func newEtcdClient(c *EtcdConfig) *etcdClient {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultEtcdTimeout
+	}
+	return &etcdClient{
+		conf:   c,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *streamer) etcdClient(c *EtcdConfig) *etcdClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.etcd == nil {
+		s.etcd = newEtcdClient(c)
+	}
+	return s.etcd
+}
+
+// authenticate gets a new auth token of the user.
+func (ec *etcdClient) authenticate(ctx context.Context) (string, error) {
+	var res struct {
+		Token string `json:"token"`
+	}
+	in := map[string]string{"name": ec.conf.Username, "password": ec.conf.Password}
+	if err := ec.post(ctx, "/v3/auth/authenticate", "", in, &res); err != nil {
+		return "", errors.Wrap(err, "failed to authenticate to etcd")
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.token = res.Token
+	return res.Token, nil
+}
+
+// call calls the API with the auth token. The token is got at the first call,
+// and got again when etcd rejects it.
+func (ec *etcdClient) call(ctx context.Context, api string, in, out interface{}) error {
+	if ec.conf.Username == "" {
+		return ec.post(ctx, api, "", in, out)
+	}
+	ec.mu.Lock()
+	token := ec.token
+	ec.mu.Unlock()
+	if token == "" {
+		var err error
+		if token, err = ec.authenticate(ctx); err != nil {
+			return err
+		}
+	}
+	err := ec.post(ctx, api, token, in, out)
+	if errors.Cause(err) != errEtcdUnauthenticated {
+		return err
+	}
+	log.Printf("[info] %s, authenticate again", err)
+	if token, err = ec.authenticate(ctx); err != nil {
+		return err
+	}
+	return ec.post(ctx, api, token, in, out)
+}
+
+// post posts the request to endpoints in order until one of them responds.
+func (ec *etcdClient) post(ctx context.Context, api, token string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range ec.conf.Endpoints {
+		u := strings.TrimSuffix(endpoint, "/") + api
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		res, err := ec.client.Do(req)
+		if err != nil {
+			log.Printf("[warn] failed to POST %s: %s", u, err)
+			lastErr = err
+			continue
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res.StatusCode == http.StatusUnauthorized && token != "" {
+			return errors.Wrapf(errEtcdUnauthenticated, "POST %s", u)
+		}
+		if res.StatusCode >= 300 {
+			return fmt.Errorf("POST %s returned %d: %s", u, res.StatusCode, strings.TrimSpace(string(b)))
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(b, out)
+	}
+	return errors.Wrap(lastErr, "all of etcd endpoints are unavailable")
+}
+
+func (ec *etcdClient) grantLease(ctx context.Context, ttl time.Duration) (etcdInt64, error) {
+	var res struct {
+		ID etcdInt64 `json:"ID"`
+	}
+	in := map[string]int64{"TTL": int64(ttl.Seconds())}
+	if err := ec.call(ctx, "/v3/lease/grant", in, &res); err != nil {
+		return "", errors.Wrap(err, "failed to grant a lease")
+	}
+	return res.ID, nil
+}
+
+// revokeLease revokes the lease. Keys attached to the lease are deleted.
+func (ec *etcdClient) revokeLease(ctx context.Context, lease etcdInt64) error {
+	in := map[string]string{"ID": string(lease)}
+	return ec.call(ctx, "/v3/lease/revoke", in, nil)
+}
+
+// put puts the key attached to the lease, and returns the lease of the previous value ("" or "0" for no lease).
+func (ec *etcdClient) put(ctx context.Context, key, value string, lease etcdInt64) (etcdInt64, error) {
+	var res struct {
+		PrevKV *etcdKeyValue `json:"prev_kv"`
+	}
+	in := map[string]interface{}{
+		"key":     base64.StdEncoding.EncodeToString([]byte(key)),
+		"value":   base64.StdEncoding.EncodeToString([]byte(value)),
+		"lease":   string(lease),
+		"prev_kv": true,
+	}
+	if err := ec.call(ctx, "/v3/kv/put", in, &res); err != nil {
+		return "", err
+	}
+	if res.PrevKV == nil {
+		return "", nil
+	}
+	return res.PrevKV.Lease, nil
+}
+
+// delete deletes the key, and returns the lease of the deleted value ("" or "0" for no lease).
+func (ec *etcdClient) delete(ctx context.Context, key string) (etcdInt64, error) {
+	var res struct {
+		PrevKVs []etcdKeyValue `json:"prev_kvs"`
+	}
+	in := map[string]interface{}{
+		"key":     base64.StdEncoding.EncodeToString([]byte(key)),
+		"prev_kv": true,
+	}
+	if err := ec.call(ctx, "/v3/kv/deleterange", in, &res); err != nil {
+		return "", err
+	}
+	if len(res.PrevKVs) == 0 {
+		return "", nil
+	}
+	return res.PrevKVs[0].Lease, nil
+}
+
+// revokePrevLease revokes the lease of the previous value of the key, so leases are not left until they expire.
+// Failures are not fatal because the lease expires in the end.
+func (ec *etcdClient) revokePrevLease(ctx context.Context, key string, prev, current etcdInt64) {
+	if prev == "" || prev == "0" || prev == current {
+		return
+	}
+	if err := ec.revokeLease(ctx, prev); err != nil {
+		log.Printf("[warn] failed to revoke the previous lease of etcd key=%s lease=%s: %s", key, prev, err)
+		return
+	}
+	log.Printf("[debug] revoked the previous lease of etcd key=%s lease=%s", key, prev)
+}
+
+// updateEtcd puts CIDRs to keys attached to leases expiring with allowances, and deletes keys for removed addresses.
+// Leases of previous values are revoked.
+// The layout of keys is the same as Consul KV.
+func (s *streamer) updateEtcd(ctx context.Context, c *EtcdConfig, v4Events []ipSetEvent, v6Events []ipSetEvent) error {
+	evs := latestEvents(v4Events, v6Events)
+	if len(evs) == 0 {
+		return nil
+	}
+	ec := s.etcdClient(c)
+	prefix := c.KeyPrefix
+	if prefix == "" {
+		prefix = DefaultEtcdKeyPrefix
+	}
+	for _, ev := range evs {
+		key := path.Join(prefix, url.PathEscape(ev.address))
+		ttl := s.elementTimeout(ev)
+		if !ev.add || ttl < time.Second {
+			if s.skipByDryRun("delete from etcd key=%s", key) {
+				continue
+			}
+			log.Printf("[info] delete from etcd key=%s", key)
+			prev, err := ec.delete(ctx, key)
+			if err != nil {
+				return errors.Wrapf(err, "failed to delete from etcd key=%s", key)
+			}
+			ec.revokePrevLease(ctx, key, prev, "")
+			continue
+		}
+		if s.skipByDryRun("put to etcd key=%s ttl=%s", key, ttl) {
+			continue
+		}
+		lease, err := ec.grantLease(ctx, ttl)
+		if err != nil {
+			return err
+		}
+		log.Printf("[info] put to etcd key=%s lease=%s ttl=%s", key, lease, ttl)
+		prev, err := ec.put(ctx, key, ev.CIDR(), lease)
+		if err != nil {
+			return errors.Wrapf(err, "failed to put to etcd key=%s", key)
+		}
+		ec.revokePrevLease(ctx, key, prev, lease)
+	}
+	return nil
+}
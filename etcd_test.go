@@ -0,0 +1,124 @@
+package knockrd_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+func TestEtcd(t *testing.T) {
+	var mu sync.Mutex
+	var ops []string
+	leaseID := 100
+	tokenID := 0
+	validToken := ""
+	leases := make(map[string]string) // lease by key
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var in map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&in)
+		decode := func(k string) string {
+			b, _ := base64.StdEncoding.DecodeString(in[k].(string))
+			return string(b)
+		}
+		if r.URL.Path != "/v3/auth/authenticate" && (validToken == "" || r.Header.Get("Authorization") != validToken) {
+			http.Error(w, `{"error":"invalid auth token","code":16}`, http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/auth/authenticate":
+			tokenID++
+			validToken = fmt.Sprintf("token%d", tokenID)
+			ops = append(ops, "authenticate")
+			fmt.Fprintf(w, `{"token":"%s"}`, validToken)
+		case "/v3/lease/grant":
+			leaseID++
+			ops = append(ops, fmt.Sprintf("grant %v", in["TTL"]))
+			fmt.Fprintf(w, `{"ID":"%d","TTL":"%v"}`, leaseID, in["TTL"])
+		case "/v3/lease/revoke":
+			ops = append(ops, fmt.Sprintf("revoke %v", in["ID"]))
+			fmt.Fprint(w, `{}`)
+		case "/v3/kv/put":
+			key := decode("key")
+			ops = append(ops, fmt.Sprintf("put %s %s lease:%s", key, decode("value"), in["lease"]))
+			if prev, ok := leases[key]; ok {
+				fmt.Fprintf(w, `{"prev_kv":{"key":"%s","lease":"%s"}}`, in["key"], prev)
+			} else {
+				fmt.Fprint(w, `{}`)
+			}
+			leases[key] = in["lease"].(string)
+		case "/v3/kv/deleterange":
+			key := decode("key")
+			ops = append(ops, fmt.Sprintf("delete %s", key))
+			if prev, ok := leases[key]; ok {
+				fmt.Fprintf(w, `{"deleted":"1","prev_kvs":[{"key":"%s","lease":"%s"}]}`, in["key"], prev)
+			} else {
+				fmt.Fprint(w, `{}`)
+			}
+			delete(leases, key)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Etcd: &knockrd.EtcdConfig{
+			Endpoints: []string{down.URL, ts.URL},
+			Username:  "knockrd",
+			Password:  "pass",
+		},
+	}
+	handler := knockrd.NewStreamHandler(conf)
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			// the token expires
+			mu.Lock()
+			validToken = ""
+			mu.Unlock()
+		}
+		if err := handler(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"authenticate",
+		"delete knockrd/allowed/198.51.100.1",
+		"grant 3600",
+		"put knockrd/allowed/198.51.100.123 198.51.100.123/32 lease:101",
+		"grant 3600",
+		"put knockrd/allowed/2001:db8::1 2001:db8::1/128 lease:102",
+		// authenticated again by the rejected token, and previous leases are revoked
+		"authenticate",
+		"delete knockrd/allowed/198.51.100.1",
+		"grant 3600",
+		"put knockrd/allowed/198.51.100.123 198.51.100.123/32 lease:103",
+		"revoke 101",
+		"grant 3600",
+		"put knockrd/allowed/2001:db8::1 2001:db8::1/128 lease:104",
+		"revoke 102",
+	}
+	if strings.Join(ops, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected operations %#v", ops)
+	}
+}
@@ -1,6 +1,181 @@
 package knockrd
 
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
+)
+
 var (
 	NoCachePrefix = noCachePrefix
 	GetRealIPAddr = getRealIPAddr
 )
+
+func SecurityGroupRuleDescriptionForRecord(r events.DynamoDBEventRecord) string {
+	ev := parseEventRecord(r)
+	if ev == nil {
+		return ""
+	}
+	return securityGroupRuleDescription(*ev)
+}
+
+type CommandExecutorFunc func(ctx context.Context, stdin string, name string, args ...string) error
+
+func (f CommandExecutorFunc) Execute(ctx context.Context, stdin string, name string, args ...string) error {
+	return f(ctx, stdin, name, args...)
+}
+
+func NewStreamHandlerWithExecutor(conf *Config, e CommandExecutorFunc) func(context.Context, events.DynamoDBEvent) error {
+	s := newStreamer(conf)
+	s.executor = e
+	return s.Handler
+}
+
+func NewStreamHandlerWithEC2(conf *Config, b Backend, client ec2iface.EC2API) func(context.Context, events.DynamoDBEvent) error {
+	s := newStreamer(conf)
+	s.backend = b
+	s.ec2 = client
+	return s.Handler
+}
+
+func NewStreamHandlerWithBackend(conf *Config, b Backend, e CommandExecutorFunc) func(context.Context, events.DynamoDBEvent) error {
+	s := newStreamer(conf)
+	s.backend = b
+	s.executor = e
+	return s.Handler
+}
+
+func NewStreamConsumerWithFile(client dynamodbstreamsiface.DynamoDBStreamsAPI, streamARN string, handler func(context.Context, events.DynamoDBEvent) error, checkpointFile string) (*streamConsumer, error) {
+	store, err := newFileCheckpointStore(checkpointFile, streamARN)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamConsumerWithClient(client, streamARN, handler, store, time.Millisecond), nil
+}
+
+func (c *streamConsumer) Poll(ctx context.Context) (bool, error) {
+	return c.poll(ctx)
+}
+
+func (c *streamConsumer) SetMaxRetries(n int) {
+	c.maxRetries = n
+}
+
+func (c *streamConsumer) ShardIDs() []string {
+	ids := make([]string, 0, len(c.shards))
+	for id := range c.shards {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func NewInProcessMemoryBackend(ctx context.Context, conf *Config, e CommandExecutorFunc) Backend {
+	b := newMemoryBackend(conf.TTL, 10*time.Millisecond)
+	s := newStreamer(conf)
+	s.backend = b
+	s.executor = e
+	return newInProcessBackend(ctx, b, s)
+}
+
+func (d *DynamoDBBackend) AcquireSweeperLock(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	return d.acquireSweeperLock(ctx, owner, ttl)
+}
+
+// NewHTTPHandlers returns handlers of /allow and /auth using the backend and policies in the config.
+// Requests to /allow are authenticated as the identity.
+func NewHTTPHandlers(b Backend, conf *Config, identity string) (http.HandlerFunc, http.HandlerFunc) {
+	backend = b
+	widening = conf.Widening
+	ttlChoices = conf.TTLChoices
+	ttlPolicies = conf.TTLPolicies
+	maxSession = conf.MaxSession
+	services = conf.Services
+	allow := func(r *http.Request) (string, bool, error) {
+		return identity, true, nil
+	}
+	return wrapHandlerFunc(allowHandler, allow), wrapHandlerFunc(authHandler, nil)
+}
+
+func (b *MemoryBackend) SetCreated(key string, created int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	item := b.items[key]
+	item.Created = created
+	b.items[key] = item
+}
+
+func (c *NetworkACLConfig) AllocateRuleNumber(used map[int64]bool) (int64, error) {
+	return c.allocateRuleNumber(used)
+}
+
+// TruncatePrefixListChanges truncates changes of CIDRs, and returns CIDRs to add and remove.
+func TruncatePrefixListChanges(add, remove []string, n int) ([]string, []string) {
+	c := &prefixListChanges{}
+	for _, cidr := range add {
+		c.add = append(c.add, &ec2.AddPrefixListEntry{Cidr: aws.String(cidr)})
+	}
+	for _, cidr := range remove {
+		c.remove = append(c.remove, &ec2.RemovePrefixListEntry{Cidr: aws.String(cidr)})
+	}
+	c = truncatePrefixListChanges(c, n)
+	var a, r []string
+	for _, e := range c.add {
+		a = append(a, aws.StringValue(e.Cidr))
+	}
+	for _, e := range c.remove {
+		r = append(r, aws.StringValue(e.Cidr))
+	}
+	return a, r
+}
+
+func SplitIPPermission(perm *ec2.IpPermission) []*ec2.IpPermission {
+	return splitIPPermission(perm)
+}
+
+func NewStreamHandlerWithWAF(conf *Config, client wafv2iface.WAFV2API) func(context.Context, events.DynamoDBEvent) error {
+	s := newStreamer(conf)
+	for _, c := range append(conf.IPSets.V4, conf.IPSets.V6...) {
+		s.wafv2[c.Region] = client
+	}
+	return s.Handler
+}
+
+func IsOptimisticLockError(err error) bool {
+	return isOptimisticLockError(err)
+}
+
+// SetMetricWriter replaces the writer of metrics, and returns a function to restore it.
+func SetMetricWriter(w io.Writer) func() {
+	orig := metricWriter
+	metricWriter = w
+	return func() { metricWriter = orig }
+}
+
+func ReconcileWithClients(ctx context.Context, conf *Config, b Backend, ec2Client ec2iface.EC2API, wafClient wafv2iface.WAFV2API, dryRun bool) ([]ReconcileDiff, error) {
+	s := newStreamer(conf)
+	s.ec2 = ec2Client
+	for _, c := range append(conf.IPSets.V4, conf.IPSets.V6...) {
+		s.wafv2[c.Region] = wafClient
+	}
+	return s.Reconcile(ctx, b, dryRun)
+}
+
+// PublishEvents publishes events for the addresses to a new event bus which is not running,
+// and returns the number of queued events.
+func PublishEvents(addrs []string) int {
+	b := newEventBus()
+	for _, addr := range addrs {
+		b.publish(*newIPSetEvent(addr, true))
+	}
+	return len(b.queue)
+}
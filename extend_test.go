@@ -0,0 +1,111 @@
+package knockrd_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/knockrd"
+)
+
+func itemOf(t *testing.T, b knockrd.Backend, key string) knockrd.Item {
+	t.Helper()
+	items, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if item.Key == key {
+			return item
+		}
+	}
+	t.Fatalf("%s is not found", key)
+	return knockrd.Item{}
+}
+
+func TestExtendAllowance(t *testing.T) {
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	conf := &knockrd.Config{
+		TTLPolicies: knockrd.TTLPolicies{
+			{Identities: []string{"*"}, MaxTTL: 4 * time.Hour},
+		},
+		MaxSession: 6 * time.Hour,
+	}
+	allow, _ := knockrd.NewHTTPHandlers(b, conf, "foo@example.com")
+
+	// not allowed yet
+	_, token := getAllow(t, allow, "198.51.100.1")
+	if w := postAllow(allow, "198.51.100.1", url.Values{"csrf_token": {token}, "extend": {"extend"}}); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+
+	_, token = getAllow(t, allow, "198.51.100.1")
+	if w := postAllow(allow, "198.51.100.1", url.Values{"csrf_token": {token}, "allow": {"allow"}}); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	allowed := itemOf(t, b, "198.51.100.1")
+
+	_, token = getAllow(t, allow, "198.51.100.1")
+	if w := postAllow(allow, "198.51.100.1", url.Values{"csrf_token": {token}, "extend": {"extend"}, "duration": {"4h"}}); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	extended := itemOf(t, b, "198.51.100.1")
+	if d := time.Until(time.Unix(extended.Expires, 0)).Round(time.Minute); d != 4*time.Hour {
+		t.Errorf("unexpected expiry after %s", d)
+	}
+	if extended.Created != allowed.Created || extended.Identity != "foo@example.com" {
+		t.Errorf("unexpected extended item %#v", extended)
+	}
+
+	// capped at the end of the max session
+	b.Set(knockrd.Item{Key: "198.51.100.1", Created: time.Now().Add(-3 * time.Hour).Unix()})
+	_, token = getAllow(t, allow, "198.51.100.1")
+	if w := postAllow(allow, "198.51.100.1", url.Values{"csrf_token": {token}, "extend": {"extend"}, "duration": {"4h"}}); w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+	if d := time.Until(time.Unix(itemOf(t, b, "198.51.100.1").Expires, 0)).Round(time.Minute); d != 3*time.Hour {
+		t.Errorf("unexpected expiry after %s", d)
+	}
+}
+
+func TestMemoryBackendExtend(t *testing.T) {
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	now := time.Now()
+	for _, c := range []struct {
+		name     string
+		item     knockrd.Item
+		expires  time.Duration
+		expected time.Duration
+	}{
+		{"extend", knockrd.Item{Created: now.Unix(), Expires: now.Add(time.Hour).Unix()}, 2 * time.Hour, 2 * time.Hour},
+		{"cap", knockrd.Item{Created: now.Add(-5 * time.Hour).Unix(), Expires: now.Add(time.Hour).Unix()}, 4 * time.Hour, 3 * time.Hour},
+		{"no shorten", knockrd.Item{Created: now.Unix(), Expires: now.Add(3 * time.Hour).Unix()}, time.Hour, 3 * time.Hour},
+		{"no shorten over the cap", knockrd.Item{Created: now.Add(-7 * time.Hour).Unix(), Expires: now.Add(time.Hour).Unix()}, 4 * time.Hour, time.Hour},
+		{"missing created", knockrd.Item{Expires: now.Add(time.Hour).Unix()}, 12 * time.Hour, 8 * time.Hour},
+	} {
+		c.item.Key = "198.51.100.1"
+		b.Set(c.item)
+		if c.item.Created == 0 {
+			// stored by older versions
+			b.SetCreated(c.item.Key, 0)
+		}
+		item, err := b.Extend(c.item.Key, now.Add(c.expires), 8*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil {
+			t.Errorf("%s: not extended", c.name)
+			continue
+		}
+		if item.Expires != now.Add(c.expected).Unix() {
+			t.Errorf("%s: unexpected expiry after %s", c.name, time.Unix(item.Expires, 0).Sub(now))
+		}
+		if item.Created == 0 {
+			t.Errorf("%s: Created must be set", c.name)
+		}
+	}
+	if item, err := b.Extend("198.51.100.2", now.Add(time.Hour), 0); err != nil || item != nil {
+		t.Errorf("must not be extended for a missing item %#v %s", item, err)
+	}
+}
@@ -0,0 +1,145 @@
+package knockrd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Firewall types
+const (
+	FirewallTypeNftables = "nftables"
+	FirewallTypeIPSet    = "ipset"
+)
+
+// commandExecutor executes external commands.
+type commandExecutor interface {
+	Execute(ctx context.Context, stdin string, name string, args ...string) error
+}
+
+type execCommandExecutor struct{}
+
+func (e execCommandExecutor) Execute(ctx context.Context, stdin string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%s %s failed: %s", name, strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (s *streamer) updateFirewall(ctx context.Context, c *FirewallConfig, v4Events []ipSetEvent, v6Events []ipSetEvent) error {
+	for _, ev := range latestEvents(v4Events, v6Events) {
+		set := c.SetV4
+		if !ev.v4 {
+			set = c.SetV6
+		}
+		if set == "" {
+			log.Printf("[debug] no %s set for %s", c.Type, ev.CIDR())
+			continue
+		}
+		var err error
+		switch c.Type {
+		case FirewallTypeNftables:
+			err = s.updateNftablesSet(ctx, c, set, ev)
+		case FirewallTypeIPSet:
+			err = s.updateIPSetCommand(ctx, set, ev)
+		default:
+			err = fmt.Errorf("invalid firewall type %s", c.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// elementTimeout returns a timeout of the element from the expiry of the event.
+// When the expiry is unknown, the longest duration of allowances is used not to expire the element before the allowance.
+func (s *streamer) elementTimeout(ev ipSetEvent) time.Duration {
+	if ev.expires.IsZero() {
+		return s.conf.maxTTL()
+	}
+	return time.Until(ev.expires).Truncate(time.Second)
+}
+
+func (s *streamer) updateNftablesSet(ctx context.Context, c *FirewallConfig, set string, ev ipSetEvent) error {
+	elem := fmt.Sprintf("%s %s %s { %s }", c.family(), c.Table, set, ev.CIDR())
+	var script string
+	if ev.add {
+		timeout := s.elementTimeout(ev)
+		if timeout < time.Second {
+			log.Printf("[info] %s is already expired", ev.CIDR())
+			return nil
+		}
+		// add (no-op for an existing element), delete and add in a transaction refreshes the timeout
+		script = strings.Join([]string{
+			"add element " + elem,
+			"delete element " + elem,
+			fmt.Sprintf("add element %s %s %s { %s timeout %ds }", c.family(), c.Table, set, ev.CIDR(), int64(timeout.Seconds())),
+		}, "\n") + "\n"
+	} else {
+		// add (no-op for an existing element) and delete in a transaction never fails by missing element
+		script = strings.Join([]string{
+			"add element " + elem,
+			"delete element " + elem,
+		}, "\n") + "\n"
+	}
+	if s.skipByDryRun("nft -f -\n%s", script) {
+		return nil
+	}
+	log.Printf("[debug] nft -f -\n%s", script)
+	if err := s.executor.Execute(ctx, script, "nft", "-f", "-"); err != nil {
+		return err
+	}
+	log.Printf("[info] %s %s nftables set %s", addOrRemove(ev.add), ev.CIDR(), set)
+	return nil
+}
+
+func (s *streamer) updateIPSetCommand(ctx context.Context, set string, ev ipSetEvent) error {
+	var args []string
+	if ev.add {
+		timeout := s.elementTimeout(ev)
+		if timeout < time.Second {
+			log.Printf("[info] %s is already expired", ev.CIDR())
+			return nil
+		}
+		// -exist updates the timeout of the existing entry
+		args = []string{"add", set, ev.CIDR(), "timeout", fmt.Sprintf("%d", int64(timeout.Seconds())), "-exist"}
+	} else {
+		args = []string{"del", set, ev.CIDR(), "-exist"}
+	}
+	if s.skipByDryRun("ipset %s", strings.Join(args, " ")) {
+		return nil
+	}
+	log.Printf("[debug] ipset %s", strings.Join(args, " "))
+	if err := s.executor.Execute(ctx, "", "ipset", args...); err != nil {
+		return err
+	}
+	log.Printf("[info] %s %s ipset %s", addOrRemove(ev.add), ev.CIDR(), set)
+	return nil
+}
+
+func (c *FirewallConfig) family() string {
+	if c.Family == "" {
+		return "inet"
+	}
+	return c.Family
+}
+
+func addOrRemove(add bool) string {
+	if add {
+		return "add"
+	}
+	return "remove"
+}
@@ -0,0 +1,69 @@
+package knockrd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+func testFirewall(t *testing.T, fw *knockrd.FirewallConfig) []string {
+	conf := &knockrd.Config{
+		TTL:      time.Hour,
+		Firewall: fw,
+	}
+	var commands []string
+	handler := knockrd.NewStreamHandlerWithExecutor(conf, func(_ context.Context, stdin string, name string, args ...string) error {
+		commands = append(commands, strings.TrimSpace(fmt.Sprintf("%s %s\n%s", name, strings.Join(args, " "), stdin)))
+		return nil
+	})
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	return commands
+}
+
+func TestFirewallIPSet(t *testing.T) {
+	commands := testFirewall(t, &knockrd.FirewallConfig{
+		Type:  knockrd.FirewallTypeIPSet,
+		SetV4: "knockrd",
+		SetV6: "knockrd6",
+	})
+	expected := []string{
+		"ipset del knockrd 198.51.100.1/32 -exist",
+		"ipset add knockrd 198.51.100.123/32 timeout 3600 -exist",
+		"ipset add knockrd6 2001:db8::1/128 timeout 3600 -exist",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands %#v", commands)
+	}
+}
+
+func TestFirewallNftables(t *testing.T) {
+	commands := testFirewall(t, &knockrd.FirewallConfig{
+		Type:  knockrd.FirewallTypeNftables,
+		Table: "filter",
+		SetV4: "knockrd_v4",
+	})
+	expected := []string{
+		`nft -f -
+add element inet filter knockrd_v4 { 198.51.100.1/32 }
+delete element inet filter knockrd_v4 { 198.51.100.1/32 }`,
+		`nft -f -
+add element inet filter knockrd_v4 { 198.51.100.123/32 }
+delete element inet filter knockrd_v4 { 198.51.100.123/32 }
+add element inet filter knockrd_v4 { 198.51.100.123/32 timeout 3600s }`,
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands %#v", commands)
+	}
+}
@@ -5,7 +5,7 @@ go 1.14
 require (
 	github.com/ReneKroon/ttlcache v1.6.0
 	github.com/aws/aws-lambda-go v1.20.0
-	github.com/aws/aws-sdk-go v1.30.8
+	github.com/aws/aws-sdk-go v1.35.0
 	github.com/deckarep/golang-set v1.7.1
 	github.com/fujiwara/go-amzn-oidc v0.0.2
 	github.com/fujiwara/ridge v0.5.0
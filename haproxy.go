@@ -0,0 +1,198 @@
+package knockrd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/pkg/errors"
+)
+
+// haproxyKeyNotFound is a response of the Runtime API for deleting a missing entry.
+const haproxyKeyNotFound = "Key not found."
+
+// syncHAProxy resyncs ACLs and maps of HAProxy with active allowances in the backend at once.
+// HAProxy loses entries added by the Runtime API on restarts, so entries are resynced when the process starts.
+func (s *streamer) syncHAProxy(ctx context.Context) error {
+	s.mu.Lock()
+	synced := s.haproxySynced
+	s.mu.Unlock()
+	if synced {
+		return nil
+	}
+	desired, err := s.activeCIDRs()
+	if err != nil {
+		return err
+	}
+	for _, c := range s.conf.HAProxy {
+		if _, err := s.reconcileHAProxy(ctx, c, desired, s.conf.DryRun); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.haproxySynced = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *streamer) updateHAProxy(ctx context.Context, c *HAProxyConfig, v4Events []ipSetEvent, v6Events []ipSetEvent) error {
+	evs := latestEvents(v4Events, v6Events)
+	if len(evs) == 0 {
+		return nil
+	}
+	current, err := c.entries(ctx)
+	if err != nil {
+		return err
+	}
+	var add, remove []string
+	for _, ev := range evs {
+		cidr := ev.CIDR()
+		exists := current[cidr]
+		if ev.add && !exists {
+			add = append(add, cidr)
+		} else if !ev.add && exists {
+			remove = append(remove, cidr)
+		} else {
+			log.Printf("[debug] %s add:%t exists:%t", c, ev.add, exists)
+		}
+	}
+	if len(add)+len(remove) > 0 && s.skipByDryRun("%s add:%v remove:%v", c, add, remove) {
+		return nil
+	}
+	return c.modify(ctx, add, remove)
+}
+
+func (s *streamer) reconcileHAProxy(ctx context.Context, c *HAProxyConfig, desired mapset.Set, dryRun bool) (ReconcileDiff, error) {
+	target := c.String()
+	entries, err := c.entries(ctx)
+	if err != nil {
+		return ReconcileDiff{Target: target}, err
+	}
+	current := mapset.NewSet()
+	for cidr := range entries {
+		current.Add(cidr)
+	}
+	diff := newReconcileDiff(target, desired, current)
+	if diff.IsEmpty() {
+		log.Printf("[info] %s is up to date", target)
+		return diff, nil
+	}
+	log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+	if dryRun {
+		return diff, nil
+	}
+	return diff, c.modify(ctx, diff.Add, diff.Remove)
+}
+
+// modify removes and adds entries by the Runtime API.
+func (c *HAProxyConfig) modify(ctx context.Context, add, remove []string) error {
+	for _, cidr := range remove {
+		var cmd string
+		if c.Map != "" {
+			cmd = fmt.Sprintf("del map %s %s", c.Map, cidr)
+		} else {
+			cmd = fmt.Sprintf("del acl %s %s", c.ACL, cidr)
+		}
+		res, err := c.command(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		if res == haproxyKeyNotFound {
+			log.Printf("[info] %s is already removed from %s", cidr, c)
+			continue
+		} else if res != "" {
+			return fmt.Errorf("%s failed: %s", cmd, res)
+		}
+		log.Printf("[info] removed %s from %s", cidr, c)
+	}
+	for _, cidr := range add {
+		var cmd string
+		if c.Map != "" {
+			cmd = fmt.Sprintf("add map %s %s %s", c.Map, cidr, c.mapValue())
+		} else {
+			cmd = fmt.Sprintf("add acl %s %s", c.ACL, cidr)
+		}
+		res, err := c.command(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		if res != "" {
+			return fmt.Errorf("%s failed: %s", cmd, res)
+		}
+		log.Printf("[info] added %s to %s", cidr, c)
+	}
+	return nil
+}
+
+// entries returns current patterns (keys of maps) in the ACL or map.
+func (c *HAProxyConfig) entries(ctx context.Context) (map[string]bool, error) {
+	var cmd string
+	if c.Map != "" {
+		cmd = "show map " + c.Map
+	} else {
+		cmd = "show acl " + c.ACL
+	}
+	res, err := c.command(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]bool)
+	for _, line := range strings.Split(res, "\n") {
+		// <reference> <pattern> [<value>]
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "0x") {
+			if line != "" {
+				return nil, fmt.Errorf("%s failed: %s", cmd, res)
+			}
+			continue
+		}
+		entries[fields[1]] = true
+	}
+	log.Printf("[debug] %s entries:%d", c, len(entries))
+	return entries, nil
+}
+
+// command sends a command to the Runtime API and returns the trimmed response.
+func (c *HAProxyConfig) command(ctx context.Context, cmd string) (string, error) {
+	network := "tcp"
+	if strings.Contains(c.Address, "/") {
+		network = "unix"
+	}
+	d := net.Dialer{Timeout: c.timeout()}
+	conn, err := d.DialContext(ctx, network, c.Address)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to connect to %s", c.Address)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout()))
+
+	log.Printf("[debug] %s %s", c.Address, cmd)
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", errors.Wrapf(err, "failed to send a command to %s", c.Address)
+	}
+	// the connection is closed by HAProxy after the response in non-interactive mode
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read a response from %s", c.Address)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (c *HAProxyConfig) mapValue() string {
+	if c.MapValue == "" {
+		return DefaultHAProxyMapValue
+	}
+	return c.MapValue
+}
+
+func (c *HAProxyConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultHAProxyTimeout
+	}
+	return c.Timeout
+}
@@ -0,0 +1,140 @@
+package knockrd_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+// fakeHAProxy serves a subset of the HAProxy Runtime API for an ACL on a unix socket.
+type fakeHAProxy struct {
+	mu       sync.Mutex
+	acl      map[string]bool
+	commands []string
+}
+
+func (f *fakeHAProxy) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprint(conn, f.handle(strings.TrimSpace(line)))
+		conn.Close()
+	}
+}
+
+func (f *fakeHAProxy) handle(cmd string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, cmd)
+	args := strings.Fields(cmd)
+	switch {
+	case len(args) == 3 && args[0] == "show" && args[1] == "acl":
+		var res string
+		for _, p := range f.sortedACL() {
+			res += fmt.Sprintf("0x55d1c0e0b0a0 %s\n", p)
+		}
+		return res + "\n"
+	case len(args) == 4 && args[0] == "add" && args[1] == "acl":
+		f.acl[args[3]] = true
+		return "\n"
+	case len(args) == 4 && args[0] == "del" && args[1] == "acl":
+		if !f.acl[args[3]] {
+			return "Key not found.\n\n"
+		}
+		delete(f.acl, args[3])
+		return "\n"
+	}
+	return "Unknown command.\n\n"
+}
+
+func (f *fakeHAProxy) sortedACL() []string {
+	var ps []string
+	for p := range f.acl {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+func TestHAProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "haproxy.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f := &fakeHAProxy{
+		acl: map[string]bool{
+			"198.51.100.1/32": true,
+			"203.0.113.1/32":  true, // stale
+		},
+	}
+	go f.serve(l)
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		HAProxy: []*knockrd.HAProxyConfig{
+			{Address: sock, ACL: "#1"},
+		},
+	}
+	b := &listBackend{
+		items: []knockrd.Item{
+			{Key: "192.0.2.1"},
+			{Key: "198.51.100.123"},
+		},
+	}
+	handler := knockrd.NewStreamHandlerWithBackend(conf, b, nil)
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := handler(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	expected := []string{"192.0.2.1/32", "198.51.100.123/32", "2001:db8::1/128"}
+	if acl := f.sortedACL(); strings.Join(acl, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected acl %v", acl)
+	}
+	expectedCommands := []string{
+		// resync on the first invocation
+		"show acl #1",
+		"del acl #1 198.51.100.1/32",
+		"del acl #1 203.0.113.1/32",
+		"add acl #1 192.0.2.1/32",
+		"add acl #1 198.51.100.123/32",
+		// events
+		"show acl #1",
+		"add acl #1 2001:db8::1/128",
+		// events at the second invocation
+		"show acl #1",
+	}
+	if strings.Join(f.commands, "\n") != strings.Join(expectedCommands, "\n") {
+		t.Errorf("unexpected commands %#v", f.commands)
+	}
+}
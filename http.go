@@ -1,12 +1,15 @@
 package knockrd
 
 import (
+	"context"
 	crand "crypto/rand"
 	"fmt"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	_ "github.com/fujiwara/knockrd/statik"
 	"github.com/rakyll/statik/fs"
@@ -14,14 +17,25 @@ import (
 
 type View struct {
 	IPAddr    string
+	Network   string // a network of a widened allowance
 	CSRFToken string
 	Message   string
+	Durations []string // choices of durations of the allowance
+	Duration  string   // the default duration
+	Services  []*ServiceConfig
 }
 
 var (
-	mux     = http.NewServeMux()
-	backend Backend
-	tmpl    = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+	mux      = http.NewServeMux()
+	backend  Backend
+	widening WideningPolicies
+
+	ttlChoices  []time.Duration
+	ttlPolicies TTLPolicies
+	maxSession  time.Duration
+	services    []*ServiceConfig
+
+	tmpl = template.Must(template.New("view").Parse(`<!DOCTYPE html>
 <html>
   <head>
 	<meta charset="utf-8">
@@ -34,11 +48,26 @@ var (
       <div class="pure-u">
 		<h1>knockrd</h1>
 		<p>Your IP address <strong>{{ .IPAddr }}</strong> {{ .Message }}</p>
+		{{ if ne .Network "" }}
+		<p>Allowances for you cover the network <strong>{{ .Network }}</strong>.</p>
+		{{ end }}
 		{{ if ne .CSRFToken "" }}
         <form class="pure-form pure-form-stacked" method="POST">
           <fieldset>
             <input type="hidden" name="csrf_token" value="{{ .CSRFToken }}">
+            {{ if .Durations }}
+            <label for="duration">Duration</label>
+            <select id="duration" name="duration">
+              {{ range .Durations }}<option value="{{ . }}"{{ if eq . $.Duration }} selected{{ end }}>{{ . }}</option>{{ end }}
+            </select>
+            {{ end }}
+            {{ range .Services }}
+            <label for="service-{{ .Name }}" class="pure-checkbox">
+              <input type="checkbox" id="service-{{ .Name }}" name="service" value="{{ .Name }}"> {{ .Name }}{{ if ne .Description "" }} - {{ .Description }}{{ end }}
+            </label>
+            {{ end }}
             <button type="submit" name="allow" value="allow" class="pure-button pure-button-primary">Allow</button>
+            <button type="submit" name="extend" value="extend" class="pure-button">Extend</button>
             <button type="submit" name="disallow" value="disallow" class="pure-button">Disallow</button>
           </fieldset>
 		</form>
@@ -65,7 +94,19 @@ func init() {
 
 type handlerFunc func(http.ResponseWriter, *http.Request) error
 
-type allowFunc func(r *http.Request) (bool, error)
+// allowFunc returns whether the request is allowed and an identity (e.g. email) of the user.
+type allowFunc func(r *http.Request) (string, bool, error)
+
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+func identityFromRequest(r *http.Request) string {
+	if id, ok := r.Context().Value(identityContextKey).(string); ok {
+		return id
+	}
+	return ""
+}
 
 func wrapHandlerFunc(h handlerFunc, allow allowFunc) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -73,7 +114,7 @@ func wrapHandlerFunc(h handlerFunc, allow allowFunc) func(http.ResponseWriter, *
 		w.Header().Set("Cache-Control", "private")
 
 		if allow != nil {
-			if ok, err := allow(r); err != nil {
+			if id, ok, err := allow(r); err != nil {
 				log.Println("[error]", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprintln(w, "Server Error")
@@ -82,6 +123,8 @@ func wrapHandlerFunc(h handlerFunc, allow allowFunc) func(http.ResponseWriter, *
 				w.WriteHeader(http.StatusForbidden)
 				fmt.Fprintln(w, "Forbidden")
 				return
+			} else {
+				r = r.WithContext(context.WithValue(r.Context(), identityContextKey, id))
 			}
 		}
 
@@ -148,12 +191,25 @@ func allowGetHandler(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	if err := backend.Set(token); err != nil {
+	if err := backend.Set(Item{Key: token}); err != nil {
 		return err
 	}
+	identity := identityFromRequest(r)
+	max := ttlPolicies.maxTTL(identity, backend.TTL())
+	ttl, _ := allowanceTTL("", backend.TTL(), max)
+	var durations []string
+	for _, d := range ttlChoices {
+		if d <= max {
+			durations = append(durations, formatDuration(d))
+		}
+	}
 	return render(w, View{
 		IPAddr:    ipaddr,
+		Network:   networkOf(ipaddr, widening.allowKey(ipaddr, identity)),
 		CSRFToken: token,
+		Durations: durations,
+		Duration:  formatDuration(ttl),
+		Services:  services,
 	})
 }
 
@@ -183,32 +239,109 @@ func allowPostHandler(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	var message string
-	if r.FormValue("allow") != "" {
-		log.Println("[debug] setting allowed IP address", ipaddr)
-		if err := backend.Set(ipaddr); err != nil {
-			return err
-		}
-		log.Printf("[info] set allowed IP address for %s TTL %s", ipaddr, backend.TTL())
-		message = fmt.Sprintf("is allowed for %s.", backend.TTL())
-	} else if r.FormValue("disallow") != "" {
-		log.Println("[debug] removing allowed IP address", ipaddr)
-		if err := backend.Delete(ipaddr); err != nil {
-			return err
-		}
-		log.Println("[info] remove allowed IP address", ipaddr)
-		message = "is disallowed."
-	} else {
+	identity := identityFromRequest(r)
+	allow, extend := r.FormValue("allow") != "", r.FormValue("extend") != ""
+	if !allow && !extend && r.FormValue("disallow") == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintln(w, "Bad request")
 		return nil
 	}
-	return render(w, View{
+	scopes, err := allowScopes(r.Form["service"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Bad request:", err)
+		return nil
+	}
+	key := widening.allowKey(ipaddr, identity)
+	if allow || extend {
+		for _, sc := range scopes {
+			sc.ttl, err = allowanceTTL(r.FormValue("duration"), sc.ttl, ttlPolicies.maxTTL(identity, sc.ttl))
+			if err != nil {
+				log.Printf("[warn] %s for %s identity %s", err, serviceKey(sc.service, key), identity)
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "Bad request:", err)
+				return nil
+			}
+		}
+	}
+
+	status := http.StatusOK
+	var messages []string
+	for _, sc := range scopes {
+		skey := serviceKey(sc.service, key)
+		var message string
+		if allow {
+			log.Println("[debug] setting allowed IP address", skey)
+			item := Item{Key: skey, Identity: identity, Expires: time.Now().Add(sc.ttl).Unix()}
+			if err := backend.Set(item); err != nil {
+				return err
+			}
+			log.Printf("[info] set allowed IP address for %s TTL %s identity %s", skey, sc.ttl, identity)
+			message = fmt.Sprintf("is allowed for %s", formatDuration(sc.ttl))
+		} else if extend {
+			log.Println("[debug] extending allowed IP address", skey)
+			item, err := backend.Extend(skey, time.Now().Add(sc.ttl), maxSession)
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				log.Printf("[info] allowed IP address for %s is not extended identity %s", skey, identity)
+				status = http.StatusConflict
+				message = "is not allowed"
+			} else {
+				until := time.Unix(item.Expires, 0)
+				log.Printf("[info] extend allowed IP address for %s until %s identity %s", skey, until.Format(time.RFC3339), identity)
+				message = fmt.Sprintf("is extended for %s", formatDuration(time.Until(until).Round(time.Minute)))
+			}
+		} else {
+			keys := []string{serviceKey(sc.service, ipaddr)}
+			if skey != keys[0] {
+				keys = append(keys, skey)
+			}
+			for _, k := range keys {
+				log.Println("[debug] removing allowed IP address", k)
+				if err := backend.Delete(k); err != nil {
+					return err
+				}
+				log.Println("[info] remove allowed IP address", k)
+			}
+			message = "is disallowed"
+		}
+		if sc.service != "" {
+			message += " to " + sc.service
+		}
+		messages = append(messages, message)
+	}
+	return renderStatus(w, status, View{
 		IPAddr:  ipaddr,
-		Message: message,
+		Network: networkOf(ipaddr, key),
+		Message: strings.Join(messages, ", ") + ".",
 	})
 }
 
+// allowScope is a scope of an allowance requested by POST /allow.
+type allowScope struct {
+	service string // empty for top level targets
+	ttl     time.Duration
+}
+
+// allowScopes returns scopes for the names of services.
+// No names means the top level targets.
+func allowScopes(names []string) ([]*allowScope, error) {
+	if len(names) == 0 {
+		return []*allowScope{{ttl: backend.TTL()}}, nil
+	}
+	scopes := make([]*allowScope, 0, len(names))
+	for _, name := range names {
+		svc := findService(services, name)
+		if svc == nil {
+			return nil, fmt.Errorf("unknown service %s", name)
+		}
+		scopes = append(scopes, &allowScope{service: svc.Name, ttl: svc.TTL})
+	}
+	return scopes, nil
+}
+
 func authHandler(w http.ResponseWriter, r *http.Request) error {
 	ipaddr, err := getRealIPAddr(r)
 	if err != nil {
@@ -216,19 +349,36 @@ func authHandler(w http.ResponseWriter, r *http.Request) error {
 		fmt.Fprintln(w, "Bad request")
 		return nil
 	}
-	if ok, err := backend.Get(ipaddr); err != nil {
-		return err
-	} else if !ok {
-		log.Println("[info] not allowed IP address", ipaddr)
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintln(w, "Forbidden")
+	service := r.FormValue("service")
+	if service != "" && findService(services, service) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Not found")
 		return nil
 	}
-	log.Println("[debug] allowed IP address", ipaddr)
-	fmt.Fprintln(w, "OK")
+	for _, key := range widening.lookupKeys(ipaddr) {
+		key = serviceKey(service, key)
+		if ok, err := backend.Get(key); err != nil {
+			return err
+		} else if ok {
+			log.Println("[debug] allowed IP address", ipaddr, "by", key)
+			fmt.Fprintln(w, "OK")
+			return nil
+		}
+	}
+	log.Println("[info] not allowed IP address", ipaddr)
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintln(w, "Forbidden")
 	return nil
 }
 
+// networkOf returns the key if it is a network which is wider than the address.
+func networkOf(ipaddr, key string) string {
+	if key == ipaddr {
+		return ""
+	}
+	return key
+}
+
 func rootHandler(w http.ResponseWriter, r *http.Request) error {
 	ipaddr, err := getRealIPAddr(r)
 	if err != nil {
@@ -248,6 +398,11 @@ func csrfToken() (string, error) {
 }
 
 func render(w http.ResponseWriter, v View) error {
+	return renderStatus(w, http.StatusOK, v)
+}
+
+func renderStatus(w http.ResponseWriter, status int, v View) error {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
 	return tmpl.ExecuteTemplate(w, "view", v)
 }
@@ -3,6 +3,9 @@ package knockrd_test
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/fujiwara/knockrd"
@@ -68,3 +71,29 @@ func TestGetRealIPAddr(t *testing.T) {
 		}
 	}
 }
+
+var csrfTokenRegexp = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// getAllow requests GET /allow from the address, and returns the body and the CSRF token.
+func getAllow(t *testing.T, allow http.HandlerFunc, ipaddr string) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/allow", nil)
+	req.Header.Set("X-Real-IP", ipaddr)
+	w := httptest.NewRecorder()
+	allow(w, req)
+	m := csrfTokenRegexp.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("csrf token not found in %s", w.Body.String())
+	}
+	return w.Body.String(), m[1]
+}
+
+// postAllow requests POST /allow with the form from the address.
+func postAllow(allow http.HandlerFunc, ipaddr string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/allow", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Real-IP", ipaddr)
+	w := httptest.NewRecorder()
+	allow(w, req)
+	return w
+}
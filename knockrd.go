@@ -1,21 +1,61 @@
 package knockrd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/fujiwara/ridge"
+	"github.com/pkg/errors"
 )
 
-// Run runs knockrd
+// Run modes
+const (
+	RunModeHTTP      = "http"
+	RunModeStream    = "stream"
+	RunModeReconcile = "reconcile"
+	RunModeSweep     = "sweep"
+)
+
+// Run runs knockrd as a http server, or as a stream function when stream is true.
 func Run(conf *Config, stream bool) error {
+	if stream {
+		return RunMode(conf, RunModeStream)
+	}
+	return RunMode(conf, RunModeHTTP)
+}
+
+// RunMode runs knockrd in the run mode.
+func RunMode(conf *Config, mode string) error {
+	if mode != RunModeHTTP && conf.Backend == BackendMemory {
+		return fmt.Errorf("run mode %s requires the dynamodb backend", mode)
+	}
+	switch mode {
+	case RunModeHTTP, RunModeStream:
+	case RunModeReconcile:
+		return runReconcile(conf)
+	case RunModeSweep:
+		return runSweep(conf)
+	default:
+		return fmt.Errorf("invalid run mode %s", mode)
+	}
 	hh, sh, err := conf.Setup()
 	if err != nil {
 		return err
 	}
-	if stream {
+	if mode == RunModeStream {
+		if !isOnLambda() {
+			return runStreamConsumer(conf, sh)
+		}
 		log.Printf("[info] starting knockrd stream function")
+		if conf.Stream.ReportBatchItemFailures {
+			lambda.Start(NewBatchItemFailuresHandler(sh))
+			return nil
+		}
 		lambda.Start(sh)
 		return nil
 	}
@@ -25,3 +65,48 @@ func Run(conf *Config, stream bool) error {
 	ridge.Run(addr, "/", hh)
 	return nil
 }
+
+func runReconcile(conf *Config) error {
+	if isOnLambda() {
+		h, err := NewReconcileHandler(conf)
+		if err != nil {
+			return err
+		}
+		log.Printf("[info] starting knockrd reconcile function")
+		lambda.Start(h)
+		return nil
+	}
+	diffs, err := Reconcile(context.Background(), conf)
+	for _, d := range diffs {
+		fmt.Print(d.String())
+	}
+	return err
+}
+
+func runSweep(conf *Config) error {
+	if isOnLambda() {
+		h, err := NewSweepHandler(conf)
+		if err != nil {
+			return err
+		}
+		log.Printf("[info] starting knockrd sweep function")
+		lambda.Start(h)
+		return nil
+	}
+	return runSweeper(conf)
+}
+
+// RunStreamEvent runs the stream handler with a DynamoDB stream event in the JSON file.
+// It is useful to check what the handler does with dry_run.
+func RunStreamEvent(conf *Config, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", path)
+	}
+	log.Printf("[info] handling %d records in %s (dry-run=%t)", len(ev.Records), path, conf.DryRun)
+	return newStreamer(conf).Handler(context.Background(), ev)
+}
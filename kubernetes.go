@@ -0,0 +1,317 @@
+package knockrd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/pkg/errors"
+	"github.com/shogo82148/go-retry"
+)
+
+// DefaultKubernetesIngressAnnotation is the annotation of ingress-nginx for allowed CIDRs.
+var DefaultKubernetesIngressAnnotation = "nginx.ingress.kubernetes.io/whitelist-source-range"
+
+const (
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// kubernetesPlaceholderCIDR is allowed when no CIDRs are allowed,
+	// because both of an empty annotation and empty peers of NetworkPolicy allow all sources.
+	kubernetesPlaceholderCIDR = "127.0.0.1/32"
+)
+
+type kubernetesClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+// kubernetesStatusError represents an error response of the Kubernetes API.
+type kubernetesStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *kubernetesStatusError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.StatusCode, e.Body)
+}
+
+func isKubernetesConflict(err error) bool {
+	if e, ok := errors.Cause(err).(*kubernetesStatusError); ok {
+		return e.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+func newKubernetesClient(c *KubernetesConfig) (*kubernetesClient, error) {
+	server, tokenFile, caFile := c.APIServer, c.TokenFile, c.CAFile
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("kubernetes.api_server is required out of a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+		if tokenFile == "" {
+			tokenFile = kubernetesServiceAccountDir + "/token"
+		}
+		if caFile == "" {
+			caFile = kubernetesServiceAccountDir + "/ca.crt"
+		}
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &kubernetesClient{
+		server:    strings.TrimSuffix(server, "/"),
+		tokenFile: tokenFile,
+		client:    &http.Client{Transport: tr, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// do calls the Kubernetes API. in is sent as a merge patch for PATCH.
+func (k *kubernetesClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, k.server+path, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	}
+	if k.tokenFile != "" {
+		// read every time because tokens of service accounts are rotated
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", k.tokenFile)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	log.Printf("[debug] %s %s %s", method, path, body.String())
+	res, err := k.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to %s %s", method, path)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read a response of %s %s", method, path)
+	}
+	if res.StatusCode >= 300 {
+		return errors.Wrapf(&kubernetesStatusError{StatusCode: res.StatusCode, Body: string(b)}, "failed to %s %s", method, path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (s *streamer) kubernetesClient() (*kubernetesClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kubernetes != nil {
+		return s.kubernetes, nil
+	}
+	k, err := newKubernetesClient(s.conf.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
+	s.kubernetes = k
+	return k, nil
+}
+
+// updateKubernetes applies active allowances in the backend to Kubernetes objects.
+// Objects have the whole of allowed CIDRs, so they are recomputed from the backend.
+func (s *streamer) updateKubernetes(ctx context.Context) error {
+	desired, err := s.activeCIDRs()
+	if err != nil {
+		return err
+	}
+	_, err = s.reconcileKubernetes(ctx, s.conf.Kubernetes, desired, s.conf.DryRun)
+	return err
+}
+
+func (s *streamer) reconcileKubernetes(ctx context.Context, c *KubernetesConfig, desired mapset.Set, dryRun bool) ([]ReconcileDiff, error) {
+	k, err := s.kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	var diffs []ReconcileDiff
+	for _, ing := range c.Ingresses {
+		diff, err := k.reconcileIngress(ctx, ing, kubernetesDesiredCIDRs(desired, ing.StaticCIDRs), dryRun)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	for _, np := range c.NetworkPolicies {
+		diff, err := k.reconcileNetworkPolicy(ctx, np, kubernetesDesiredCIDRs(desired, np.StaticCIDRs), dryRun)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+func kubernetesDesiredCIDRs(active mapset.Set, static []string) mapset.Set {
+	desired := active.Clone()
+	for _, cidr := range static {
+		desired.Add(cidr)
+	}
+	if desired.Cardinality() == 0 {
+		desired.Add(kubernetesPlaceholderCIDR)
+	}
+	return desired
+}
+
+func (k *kubernetesClient) reconcileIngress(ctx context.Context, c *KubernetesIngressConfig, desired mapset.Set, dryRun bool) (ReconcileDiff, error) {
+	target := c.String()
+	annotation := c.Annotation
+	if annotation == "" {
+		annotation = DefaultKubernetesIngressAnnotation
+	}
+	path := fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/ingresses/%s", url.PathEscape(c.Namespace), url.PathEscape(c.Name))
+	var ing struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := k.do(ctx, http.MethodGet, path, nil, &ing); err != nil {
+		return ReconcileDiff{Target: target}, err
+	}
+	current := mapset.NewSet()
+	for _, cidr := range strings.Split(ing.Metadata.Annotations[annotation], ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			current.Add(cidr)
+		}
+	}
+	diff := newReconcileDiff(target, desired, current)
+	if diff.IsEmpty() {
+		log.Printf("[info] %s is up to date", target)
+		return diff, nil
+	}
+	log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+	if dryRun {
+		return diff, nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				annotation: strings.Join(sortedStrings(desired), ","),
+			},
+		},
+	}
+	if err := k.do(ctx, http.MethodPatch, path, patch, nil); err != nil {
+		return diff, err
+	}
+	log.Printf("[info] patched %s", target)
+	return diff, nil
+}
+
+// reconcileNetworkPolicy replaces ipBlock peers (without except) of the ingress rule by desired CIDRs.
+// Other peers (e.g. podSelector) are kept.
+func (k *kubernetesClient) reconcileNetworkPolicy(ctx context.Context, c *KubernetesNetworkPolicyConfig, desired mapset.Set, dryRun bool) (ReconcileDiff, error) {
+	target := c.String()
+	diff := ReconcileDiff{Target: target}
+	path := fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/networkpolicies/%s", url.PathEscape(c.Namespace), url.PathEscape(c.Name))
+	err := retryPolicy.Do(ctx, func() error {
+		var np struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+			Spec struct {
+				Ingress []map[string]interface{} `json:"ingress"`
+			} `json:"spec"`
+		}
+		if err := k.do(ctx, http.MethodGet, path, nil, &np); err != nil {
+			return retry.MarkPermanent(err)
+		}
+		if c.RuleIndex >= len(np.Spec.Ingress) {
+			return retry.MarkPermanent(fmt.Errorf("%s is not found", target))
+		}
+		rule := np.Spec.Ingress[c.RuleIndex]
+		peers, _ := rule["from"].([]interface{})
+		current := mapset.NewSet()
+		var from []interface{}
+		for _, peer := range peers {
+			if cidr, ok := managedIPBlockCIDR(peer); ok {
+				current.Add(cidr)
+			} else {
+				from = append(from, peer)
+			}
+		}
+		diff = newReconcileDiff(target, desired, current)
+		if diff.IsEmpty() {
+			log.Printf("[info] %s is up to date", target)
+			return nil
+		}
+		log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+		if dryRun {
+			return nil
+		}
+		for _, cidr := range sortedStrings(desired) {
+			from = append(from, map[string]interface{}{
+				"ipBlock": map[string]interface{}{"cidr": cidr},
+			})
+		}
+		rule["from"] = from
+		// lists are replaced by a merge patch. resourceVersion makes the patch fail by conflicts
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": np.Metadata.ResourceVersion},
+			"spec":     map[string]interface{}{"ingress": np.Spec.Ingress},
+		}
+		if err := k.do(ctx, http.MethodPatch, path, patch, nil); isKubernetesConflict(err) {
+			log.Printf("[warn] %s is modified by others, retrying", target)
+			return err
+		} else if err != nil {
+			return retry.MarkPermanent(err)
+		}
+		log.Printf("[info] patched %s", target)
+		return nil
+	})
+	return diff, err
+}
+
+func managedIPBlockCIDR(peer interface{}) (string, bool) {
+	p, ok := peer.(map[string]interface{})
+	if !ok || len(p) != 1 {
+		return "", false
+	}
+	block, ok := p["ipBlock"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	if _, ok := block["except"]; ok {
+		return "", false
+	}
+	cidr, ok := block["cidr"].(string)
+	return cidr, ok
+}
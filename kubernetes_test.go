@@ -0,0 +1,158 @@
+package knockrd_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+// fakeKubernetes serves GET and PATCH (JSON merge patch) of objects.
+type fakeKubernetes struct {
+	mu      sync.Mutex
+	objects map[string]map[string]interface{}
+	patches int
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[r.URL.Path]
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(obj)
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var patch map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		meta := obj["metadata"].(map[string]interface{})
+		if rv, ok := patch["metadata"].(map[string]interface{})["resourceVersion"]; ok && rv != meta["resourceVersion"] {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+		mergePatch(obj, patch)
+		meta["resourceVersion"] = "2"
+		f.patches++
+		json.NewEncoder(w).Encode(obj)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func mergePatch(obj, patch map[string]interface{}) {
+	for k, v := range patch {
+		if pv, ok := v.(map[string]interface{}); ok {
+			if ov, ok := obj[k].(map[string]interface{}); ok {
+				mergePatch(ov, pv)
+				continue
+			}
+		}
+		if v == nil {
+			delete(obj, k)
+		} else {
+			obj[k] = v
+		}
+	}
+}
+
+func decodeJSON(t *testing.T, s string) map[string]interface{} {
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestKubernetes(t *testing.T) {
+	ingPath := "/apis/networking.k8s.io/v1/namespaces/default/ingresses/web"
+	npPath := "/apis/networking.k8s.io/v1/namespaces/default/networkpolicies/ssh"
+	f := &fakeKubernetes{
+		objects: map[string]map[string]interface{}{
+			ingPath: decodeJSON(t, `{
+				"metadata": {"name": "web", "resourceVersion": "1", "annotations": {
+					"nginx.ingress.kubernetes.io/whitelist-source-range": "198.51.100.1/32"
+				}}
+			}`),
+			npPath: decodeJSON(t, `{
+				"metadata": {"name": "ssh", "resourceVersion": "1"},
+				"spec": {"ingress": [{
+					"ports": [{"port": 22}],
+					"from": [
+						{"podSelector": {"matchLabels": {"app": "bastion"}}},
+						{"ipBlock": {"cidr": "198.51.100.1/32"}}
+					]
+				}]}
+			}`),
+		},
+	}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Kubernetes: &knockrd.KubernetesConfig{
+			APIServer: ts.URL,
+			Ingresses: []*knockrd.KubernetesIngressConfig{
+				{Namespace: "default", Name: "web", StaticCIDRs: []string{"10.0.0.0/8"}},
+			},
+			NetworkPolicies: []*knockrd.KubernetesNetworkPolicyConfig{
+				{Namespace: "default", Name: "ssh"},
+			},
+		},
+	}
+	b := &listBackend{
+		items: []knockrd.Item{
+			{Key: "198.51.100.123"},
+			{Key: "2001:db8::1"},
+		},
+	}
+	handler := knockrd.NewStreamHandlerWithBackend(conf, b, nil)
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := handler(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// patched once for each object, because they are up to date at the second time
+	if f.patches != 2 {
+		t.Errorf("unexpected patches %d", f.patches)
+	}
+	annotations := f.objects[ingPath]["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	if v := annotations["nginx.ingress.kubernetes.io/whitelist-source-range"]; v != "10.0.0.0/8,198.51.100.123/32,2001:db8::1/128" {
+		t.Errorf("unexpected annotation %s", v)
+	}
+	expected := decodeJSON(t, `{"ingress": [{
+		"ports": [{"port": 22}],
+		"from": [
+			{"podSelector": {"matchLabels": {"app": "bastion"}}},
+			{"ipBlock": {"cidr": "198.51.100.123/32"}},
+			{"ipBlock": {"cidr": "2001:db8::1/128"}}
+		]
+	}]}`)
+	if spec := f.objects[npPath]["spec"]; !reflect.DeepEqual(spec, expected) {
+		t.Errorf("unexpected spec %#v", spec)
+	}
+}
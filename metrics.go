@@ -0,0 +1,56 @@
+package knockrd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// MetricNamespace is a namespace of CloudWatch metrics
+var MetricNamespace = "knockrd"
+
+var metricWriter io.Writer = os.Stdout
+
+type emfMetricDirective struct {
+	Namespace  string              `json:"Namespace"`
+	Dimensions [][]string          `json:"Dimensions"`
+	Metrics    []map[string]string `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64                `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+}
+
+// putMetric emits a metric in CloudWatch embedded metric format to stdout in any runtime mode.
+// On Lambda, CloudWatch extracts metrics from the function logs. Otherwise, ship stdout to CloudWatch Logs
+// (e.g. by the CloudWatch agent or awslogs driver of ECS) to extract them.
+func putMetric(name string, value float64, unit string, dimensions map[string]string) {
+	log.Printf("[debug] metric %s=%g %s %v", name, value, unit, dimensions)
+	keys := make([]string, 0, len(dimensions))
+	m := make(map[string]interface{}, len(dimensions)+2)
+	for k, v := range dimensions {
+		keys = append(keys, k)
+		m[k] = v
+	}
+	m[name] = value
+	m["_aws"] = emfMetadata{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfMetricDirective{
+			{
+				Namespace:  MetricNamespace,
+				Dimensions: [][]string{keys},
+				Metrics:    []map[string]string{{"Name": name, "Unit": unit}},
+			},
+		},
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("[warn] failed to marshal metric %s: %s", name, err)
+		return
+	}
+	fmt.Fprintln(metricWriter, string(b))
+}
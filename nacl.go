@@ -0,0 +1,215 @@
+package knockrd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/pkg/errors"
+)
+
+const (
+	ec2ErrCodeNetworkAclEntryAlreadyExists   = "NetworkAclEntryAlreadyExists"
+	ec2ErrCodeInvalidNetworkAclEntryNotFound = "InvalidNetworkAclEntry.NotFound"
+)
+
+// protocolNumbers maps protocol names to numbers for network ACL entries.
+var protocolNumbers = map[string]string{
+	"tcp":    "6",
+	"udp":    "17",
+	"icmp":   "1",
+	"icmpv6": "58",
+	"all":    "-1",
+}
+
+func (s *streamer) updateNetworkACL(c *NetworkACLConfig, v4Events []ipSetEvent, v6Events []ipSetEvent) error {
+	evs := latestEvents(v4Events, v6Events)
+	if len(evs) == 0 {
+		return nil
+	}
+	entries, used, err := s.describeNetworkACLEntries(c)
+	if err != nil {
+		return err
+	}
+	var add, remove []string
+	for _, ev := range evs {
+		cidr := ev.CIDR()
+		_, exists := entries[cidr]
+		if ev.add && !exists {
+			add = append(add, cidr)
+		} else if !ev.add && exists {
+			remove = append(remove, cidr)
+		} else {
+			log.Printf("[debug] %s add:%t exists:%t", c, ev.add, exists)
+		}
+	}
+	return s.modifyNetworkACL(c, entries, used, add, remove)
+}
+
+// modifyNetworkACL deletes entries for remove, and creates entries for add with free rule numbers in the range.
+// entries and used are updated in place.
+func (s *streamer) modifyNetworkACL(c *NetworkACLConfig, entries map[string][]int64, used map[int64]bool, add, remove []string) error {
+	// remove first to free rule numbers
+	for _, cidr := range remove {
+		for _, n := range entries[cidr] {
+			if err := s.deleteNetworkACLEntry(c, n); err != nil {
+				return err
+			}
+			delete(used, n)
+		}
+		delete(entries, cidr)
+	}
+	for _, cidr := range add {
+		if _, exists := entries[cidr]; exists {
+			continue
+		}
+		for {
+			n, err := c.allocateRuleNumber(used)
+			if err != nil {
+				return errors.Wrapf(err, "failed to add %s to %s", cidr, c)
+			}
+			used[n] = true
+			err = s.createNetworkACLEntry(c, n, cidr)
+			if isAWSErrorCode(err, ec2ErrCodeNetworkAclEntryAlreadyExists) {
+				// allocated by other process
+				log.Printf("[warn] rule number %d of %s is already used, trying next", n, c)
+				continue
+			} else if err != nil {
+				return err
+			}
+			entries[cidr] = []int64{n}
+			break
+		}
+	}
+	return nil
+}
+
+func (s *streamer) createNetworkACLEntry(c *NetworkACLConfig, n int64, cidr string) error {
+	in := &ec2.CreateNetworkAclEntryInput{
+		NetworkAclId: aws.String(c.ID),
+		RuleNumber:   aws.Int64(n),
+		Egress:       aws.Bool(false),
+		Protocol:     aws.String(c.protocolNumber()),
+		RuleAction:   aws.String(ec2.RuleActionAllow),
+	}
+	switch c.protocolNumber() {
+	case "-1":
+		// all protocols and ports
+	case "1", "58":
+		in.IcmpTypeCode = &ec2.IcmpTypeCode{Type: aws.Int64(-1), Code: aws.Int64(-1)}
+	default:
+		in.PortRange = &ec2.PortRange{
+			From: aws.Int64(c.FromPort),
+			To:   aws.Int64(c.ToPort),
+		}
+	}
+	if strings.Contains(cidr, ":") {
+		in.Ipv6CidrBlock = aws.String(cidr)
+	} else {
+		in.CidrBlock = aws.String(cidr)
+	}
+	if s.skipByDryRun("create entry %s rule number:%d cidr:%s", c, n, cidr) {
+		return nil
+	}
+	log.Printf("[debug] creating entry %s", JSONString(in))
+	if _, err := s.ec2.CreateNetworkAclEntry(in); err != nil {
+		if isAWSErrorCode(err, ec2ErrCodeNetworkAclEntryAlreadyExists) {
+			return err
+		}
+		return errors.Wrapf(err, "failed to CreateNetworkAclEntry for %s", c.ID)
+	}
+	log.Printf("[info] created entry %s rule number:%d cidr:%s", c, n, cidr)
+	return nil
+}
+
+func (s *streamer) deleteNetworkACLEntry(c *NetworkACLConfig, n int64) error {
+	if s.skipByDryRun("delete entry %s rule number:%d", c, n) {
+		return nil
+	}
+	_, err := s.ec2.DeleteNetworkAclEntry(&ec2.DeleteNetworkAclEntryInput{
+		NetworkAclId: aws.String(c.ID),
+		RuleNumber:   aws.Int64(n),
+		Egress:       aws.Bool(false),
+	})
+	if isAWSErrorCode(err, ec2ErrCodeInvalidNetworkAclEntryNotFound) {
+		log.Printf("[info] entry %s rule number:%d is already deleted", c, n)
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to DeleteNetworkAclEntry for %s", c.ID)
+	}
+	log.Printf("[info] deleted entry %s rule number:%d", c, n)
+	return nil
+}
+
+// describeNetworkACLEntries returns CIDRs => rule numbers of ingress entries in the range of the config,
+// and all of rule numbers used by ingress entries.
+func (s *streamer) describeNetworkACLEntries(c *NetworkACLConfig) (map[string][]int64, map[int64]bool, error) {
+	res, err := s.ec2.DescribeNetworkAcls(&ec2.DescribeNetworkAclsInput{
+		NetworkAclIds: []*string{aws.String(c.ID)},
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to DescribeNetworkAcls for %s", c.ID)
+	}
+	entries := make(map[string][]int64)
+	used := make(map[int64]bool)
+	for _, acl := range res.NetworkAcls {
+		for _, e := range acl.Entries {
+			if aws.BoolValue(e.Egress) {
+				continue
+			}
+			n := aws.Int64Value(e.RuleNumber)
+			used[n] = true
+			if n < c.RuleNumberFrom || c.RuleNumberTo < n {
+				continue
+			}
+			cidr := aws.StringValue(e.CidrBlock)
+			if cidr == "" {
+				cidr = aws.StringValue(e.Ipv6CidrBlock)
+			}
+			entries[cidr] = append(entries[cidr], n)
+		}
+	}
+	log.Printf("[debug] %s managed entries:%v", c, entries)
+	return entries, used, nil
+}
+
+func (c *NetworkACLConfig) allocateRuleNumber(used map[int64]bool) (int64, error) {
+	for n := c.RuleNumberFrom; n <= c.RuleNumberTo; n++ {
+		if !used[n] {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("no rule numbers are available in %d-%d", c.RuleNumberFrom, c.RuleNumberTo)
+}
+
+func (c *NetworkACLConfig) protocolNumber() string {
+	if n, ok := protocolNumbers[strings.ToLower(c.Protocol)]; ok {
+		return n
+	}
+	return c.Protocol
+}
+
+func (s *streamer) reconcileNetworkACL(c *NetworkACLConfig, desired mapset.Set, dryRun bool) (ReconcileDiff, error) {
+	target := c.String()
+	entries, used, err := s.describeNetworkACLEntries(c)
+	if err != nil {
+		return ReconcileDiff{Target: target}, err
+	}
+	current := mapset.NewSet()
+	for cidr := range entries {
+		current.Add(cidr)
+	}
+	diff := newReconcileDiff(target, desired, current)
+	if diff.IsEmpty() {
+		log.Printf("[info] %s is up to date", target)
+		return diff, nil
+	}
+	log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+	if dryRun {
+		return diff, nil
+	}
+	return diff, s.modifyNetworkACL(c, entries, used, diff.Add, diff.Remove)
+}
@@ -0,0 +1,221 @@
+package knockrd_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fujiwara/knockrd"
+)
+
+func (f *fakeEC2) DescribeNetworkAcls(in *ec2.DescribeNetworkAclsInput) (*ec2.DescribeNetworkAclsOutput, error) {
+	out := &ec2.DescribeNetworkAclsOutput{}
+	for _, id := range in.NetworkAclIds {
+		acl, ok := f.acls[aws.StringValue(id)]
+		if !ok {
+			continue
+		}
+		out.NetworkAcls = append(out.NetworkAcls, &ec2.NetworkAcl{
+			NetworkAclId: acl.NetworkAclId,
+			Entries:      append([]*ec2.NetworkAclEntry{}, acl.Entries...),
+		})
+	}
+	if f.afterDescribe != nil {
+		f.afterDescribe()
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) CreateNetworkAclEntry(in *ec2.CreateNetworkAclEntryInput) (*ec2.CreateNetworkAclEntryOutput, error) {
+	cidr := aws.StringValue(in.CidrBlock) + aws.StringValue(in.Ipv6CidrBlock)
+	call := fmt.Sprintf("create %d %s proto:%s", aws.Int64Value(in.RuleNumber), cidr, aws.StringValue(in.Protocol))
+	if in.PortRange != nil {
+		call += fmt.Sprintf(" ports:%d-%d", aws.Int64Value(in.PortRange.From), aws.Int64Value(in.PortRange.To))
+	}
+	f.calls = append(f.calls, call)
+	acl := f.acls[aws.StringValue(in.NetworkAclId)]
+	for _, e := range acl.Entries {
+		if aws.Int64Value(e.RuleNumber) == aws.Int64Value(in.RuleNumber) && !aws.BoolValue(e.Egress) {
+			return nil, awserr.New("NetworkAclEntryAlreadyExists", "the rule number already exists", nil)
+		}
+	}
+	acl.Entries = append(acl.Entries, &ec2.NetworkAclEntry{
+		RuleNumber:    in.RuleNumber,
+		Egress:        in.Egress,
+		CidrBlock:     in.CidrBlock,
+		Ipv6CidrBlock: in.Ipv6CidrBlock,
+		Protocol:      in.Protocol,
+		PortRange:     in.PortRange,
+	})
+	return &ec2.CreateNetworkAclEntryOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteNetworkAclEntry(in *ec2.DeleteNetworkAclEntryInput) (*ec2.DeleteNetworkAclEntryOutput, error) {
+	f.calls = append(f.calls, fmt.Sprintf("delete %d", aws.Int64Value(in.RuleNumber)))
+	acl := f.acls[aws.StringValue(in.NetworkAclId)]
+	for i, e := range acl.Entries {
+		if aws.Int64Value(e.RuleNumber) == aws.Int64Value(in.RuleNumber) && !aws.BoolValue(e.Egress) {
+			acl.Entries = append(acl.Entries[:i], acl.Entries[i+1:]...)
+			return &ec2.DeleteNetworkAclEntryOutput{}, nil
+		}
+	}
+	return nil, awserr.New("InvalidNetworkAclEntry.NotFound", "the entry does not exist", nil)
+}
+
+// addNetworkACLEntry adds an ingress entry to the network ACL.
+func (f *fakeEC2) addNetworkACLEntry(id string, n int64, cidr string) {
+	acl, ok := f.acls[id]
+	if !ok {
+		acl = &ec2.NetworkAcl{NetworkAclId: aws.String(id)}
+		f.acls[id] = acl
+	}
+	acl.Entries = append(acl.Entries, &ec2.NetworkAclEntry{
+		RuleNumber: aws.Int64(n),
+		Egress:     aws.Bool(false),
+		CidrBlock:  aws.String(cidr),
+	})
+}
+
+func (f *fakeEC2) networkACLEntries(id string) []string {
+	var entries []string
+	for _, e := range f.acls[id].Entries {
+		entries = append(entries, fmt.Sprintf("%d %s", aws.Int64Value(e.RuleNumber), aws.StringValue(e.CidrBlock)+aws.StringValue(e.Ipv6CidrBlock)))
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func TestAllocateRuleNumber(t *testing.T) {
+	c := &knockrd.NetworkACLConfig{ID: "acl-1", RuleNumberFrom: 100, RuleNumberTo: 103}
+	for _, tc := range []struct {
+		name     string
+		used     []int64
+		expected int64
+		err      bool
+	}{
+		{"empty", nil, 100, false},
+		{"used out of the range", []int64{1, 99, 104, 32767}, 100, false},
+		{"gap", []int64{100, 101, 103}, 102, false},
+		{"last", []int64{100, 101, 102}, 103, false},
+		{"exhausted", []int64{100, 101, 102, 103}, 0, true},
+	} {
+		used := make(map[int64]bool)
+		for _, n := range tc.used {
+			used[n] = true
+		}
+		n, err := c.AllocateRuleNumber(used)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %d", tc.name, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+		} else if n != tc.expected {
+			t.Errorf("%s: unexpected rule number %d", tc.name, n)
+		}
+	}
+}
+
+func TestNetworkACL(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		acl      knockrd.NetworkACLConfig
+		entries  map[int64]string
+		raced    map[int64]string
+		keys     []string
+		expected []string
+		entryErr bool
+	}{
+		{
+			name:    "fill a gap",
+			acl:     knockrd.NetworkACLConfig{ID: "acl-1", RuleNumberFrom: 100, RuleNumberTo: 110, Protocol: "tcp", FromPort: 22, ToPort: 22},
+			entries: map[int64]string{100: "192.0.2.1/32", 102: "192.0.2.2/32", 32767: "0.0.0.0/0"},
+			keys:    []string{"198.51.100.1", "2001:db8::1"},
+			expected: []string{
+				"create 101 198.51.100.1/32 proto:6 ports:22-22",
+				"create 103 2001:db8::1/128 proto:6 ports:22-22",
+			},
+		},
+		{
+			name:    "retry on collisions",
+			acl:     knockrd.NetworkACLConfig{ID: "acl-1", RuleNumberFrom: 100, RuleNumberTo: 110, Protocol: "all"},
+			entries: map[int64]string{100: "192.0.2.1/32"},
+			raced:   map[int64]string{101: "192.0.2.2/32", 102: "192.0.2.3/32"},
+			keys:    []string{"198.51.100.1"},
+			expected: []string{
+				"create 101 198.51.100.1/32 proto:-1",
+				"create 102 198.51.100.1/32 proto:-1",
+				"create 103 198.51.100.1/32 proto:-1",
+			},
+		},
+		{
+			name:     "exhausted",
+			acl:      knockrd.NetworkACLConfig{ID: "acl-1", RuleNumberFrom: 100, RuleNumberTo: 101, Protocol: "udp", FromPort: 53, ToPort: 53},
+			entries:  map[int64]string{100: "192.0.2.1/32"},
+			raced:    map[int64]string{101: "192.0.2.2/32"},
+			keys:     []string{"198.51.100.1"},
+			expected: []string{"create 101 198.51.100.1/32 proto:17 ports:53-53"},
+			entryErr: true,
+		},
+	} {
+		client := newFakeEC2()
+		for n, cidr := range tc.entries {
+			client.addNetworkACLEntry("acl-1", n, cidr)
+		}
+		client.afterDescribe = func() {
+			for n, cidr := range tc.raced {
+				client.addNetworkACLEntry("acl-1", n, cidr)
+			}
+			client.afterDescribe = nil
+		}
+		acl := tc.acl
+		conf := &knockrd.Config{TTL: time.Hour, NetworkACLs: []*knockrd.NetworkACLConfig{&acl}}
+		b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+		handler := knockrd.NewStreamHandlerWithEC2(conf, b, client)
+		err := handler(context.Background(), insertEvent(tc.keys...))
+		if tc.entryErr && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		} else if !tc.entryErr && err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+		}
+		if strings.Join(client.calls, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("%s: unexpected calls %#v", tc.name, client.calls)
+		}
+	}
+}
+
+func TestNetworkACLRemove(t *testing.T) {
+	client := newFakeEC2()
+	client.addNetworkACLEntry("acl-1", 100, "198.51.100.1/32")
+	client.addNetworkACLEntry("acl-1", 101, "198.51.100.2/32")
+	client.addNetworkACLEntry("acl-1", 200, "198.51.100.1/32") // out of the range
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		NetworkACLs: []*knockrd.NetworkACLConfig{
+			{ID: "acl-1", RuleNumberFrom: 100, RuleNumberTo: 110, Protocol: "tcp", FromPort: 22, ToPort: 22},
+		},
+	}
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	handler := knockrd.NewStreamHandlerWithEC2(conf, b, client)
+	ev := insertEvent("198.51.100.1", "198.51.100.3")
+	ev.Records[0].EventName = "REMOVE"
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	// the freed rule number is reused
+	expected := []string{"delete 100", "create 100 198.51.100.3/32 proto:6 ports:22-22"}
+	if strings.Join(client.calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected calls %#v", client.calls)
+	}
+	if entries := strings.Join(client.networkACLEntries("acl-1"), ","); entries != "100 198.51.100.3/32,101 198.51.100.2/32,200 198.51.100.1/32" {
+		t.Errorf("unexpected entries %s", entries)
+	}
+}
@@ -0,0 +1,217 @@
+package knockrd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/pkg/errors"
+	"github.com/shogo82148/go-retry"
+)
+
+const (
+	ec2ErrCodePrefixListVersionMismatch = "PrefixListVersionMismatch"
+	ec2ErrCodeIncorrectState            = "IncorrectState"
+
+	// maxPrefixListModifyEntries is the max number of entries for a ModifyManagedPrefixList call.
+	maxPrefixListModifyEntries = 100
+)
+
+type prefixListChanges struct {
+	add    []*ec2.AddPrefixListEntry
+	remove []*ec2.RemovePrefixListEntry
+}
+
+func (c *prefixListChanges) len() int {
+	return len(c.add) + len(c.remove)
+}
+
+// entries returns the number of entries after the changes are applied to current entries.
+func (c *prefixListChanges) entries(current map[string]string) int64 {
+	n := int64(len(current))
+	for _, e := range c.add {
+		if _, exists := current[aws.StringValue(e.Cidr)]; !exists {
+			n++
+		}
+	}
+	for _, e := range c.remove {
+		if _, exists := current[aws.StringValue(e.Cidr)]; exists {
+			n--
+		}
+	}
+	return n
+}
+
+func (s *streamer) updatePrefixList(ctx context.Context, c *PrefixListConfig, events []ipSetEvent) error {
+	evs := latestEvents(events)
+	if c.ID == "" || len(evs) == 0 {
+		return nil
+	}
+	return s.modifyPrefixList(ctx, c, func(entries map[string]string) *prefixListChanges {
+		changes := &prefixListChanges{}
+		for _, ev := range evs {
+			cidr := ev.CIDR()
+			description, exists := entries[cidr]
+			if ev.add {
+				d := securityGroupRuleDescription(ev)
+				if exists && description == d {
+					log.Printf("[debug] %s already has %s", c, cidr)
+					continue
+				}
+				// adding an existing entry updates the description (e.g. extended expiry)
+				changes.add = append(changes.add, &ec2.AddPrefixListEntry{
+					Cidr:        aws.String(cidr),
+					Description: aws.String(d),
+				})
+			} else {
+				if !exists {
+					log.Printf("[debug] %s does not have %s", c, cidr)
+					continue
+				}
+				changes.remove = append(changes.remove, &ec2.RemovePrefixListEntry{
+					Cidr: aws.String(cidr),
+				})
+			}
+		}
+		return changes
+	})
+}
+
+// modifyPrefixList modifies the prefix list by changes which are computed by diff from current entries.
+// Modifications are retried by retryPolicy when the version of the prefix list is mismatched or the list is in progress of modification.
+func (s *streamer) modifyPrefixList(ctx context.Context, c *PrefixListConfig, diff func(entries map[string]string) *prefixListChanges) error {
+	for {
+		var more bool
+		err := retryPolicy.Do(ctx, func() error {
+			pl, entries, err := s.getPrefixList(c)
+			if err != nil {
+				return err
+			}
+			version := aws.Int64Value(pl.Version)
+			changes := diff(entries)
+			if changes.len() == 0 {
+				more = false
+				return nil
+			}
+			if n, max := changes.entries(entries), aws.Int64Value(pl.MaxEntries); max > 0 && n > max {
+				return retry.MarkPermanent(fmt.Errorf("%s can't have %d entries, the max entries is %d", c, n, max))
+			}
+			if s.skipByDryRun("modify %s add:%s remove:%s", c, JSONString(changes.add), JSONString(changes.remove)) {
+				more = false
+				return nil
+			}
+			// a request can contain up to 100 entries
+			more = changes.len() > maxPrefixListModifyEntries
+			changes = truncatePrefixListChanges(changes, maxPrefixListModifyEntries)
+			log.Printf("[debug] modify %s version:%d add:%s remove:%s", c, version, JSONString(changes.add), JSONString(changes.remove))
+			_, err = s.ec2.ModifyManagedPrefixList(&ec2.ModifyManagedPrefixListInput{
+				PrefixListId:   aws.String(c.ID),
+				CurrentVersion: aws.Int64(version),
+				AddEntries:     changes.add,
+				RemoveEntries:  changes.remove,
+			})
+			if isAWSErrorCode(err, ec2ErrCodePrefixListVersionMismatch) || isAWSErrorCode(err, ec2ErrCodeIncorrectState) {
+				log.Printf("[warn] modify %s conflicted, retrying: %s", c, err)
+				return err
+			} else if err != nil {
+				return retry.MarkPermanent(errors.Wrapf(err, "failed to ModifyManagedPrefixList for %s", c.ID))
+			}
+			log.Printf("[info] modified %s add:%d remove:%d", c, len(changes.add), len(changes.remove))
+			return nil
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// getPrefixList returns the prefix list and its current entries (CIDR => description).
+func (s *streamer) getPrefixList(c *PrefixListConfig) (*ec2.ManagedPrefixList, map[string]string, error) {
+	res, err := s.ec2.DescribeManagedPrefixLists(&ec2.DescribeManagedPrefixListsInput{
+		PrefixListIds: []*string{aws.String(c.ID)},
+	})
+	if err != nil {
+		return nil, nil, retry.MarkPermanent(errors.Wrapf(err, "failed to DescribeManagedPrefixLists for %s", c.ID))
+	}
+	if len(res.PrefixLists) == 0 {
+		return nil, nil, retry.MarkPermanent(fmt.Errorf("prefix list %s is not found", c.ID))
+	}
+	pl := res.PrefixLists[0]
+	state := aws.StringValue(pl.State)
+	if strings.HasSuffix(state, "-in-progress") {
+		// retryable
+		return nil, nil, fmt.Errorf("%s is in state %s", c, state)
+	}
+	version := aws.Int64Value(pl.Version)
+	entries := make(map[string]string)
+	err = s.ec2.GetManagedPrefixListEntriesPages(&ec2.GetManagedPrefixListEntriesInput{
+		PrefixListId:  aws.String(c.ID),
+		TargetVersion: aws.Int64(version),
+	}, func(out *ec2.GetManagedPrefixListEntriesOutput, _ bool) bool {
+		for _, e := range out.Entries {
+			entries[aws.StringValue(e.Cidr)] = aws.StringValue(e.Description)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, retry.MarkPermanent(errors.Wrapf(err, "failed to GetManagedPrefixListEntries for %s", c.ID))
+	}
+	log.Printf("[debug] %s version:%d entries:%d", c, version, len(entries))
+	return pl, entries, nil
+}
+
+// truncatePrefixListChanges returns the first n changes. Removals come first to free entries for additions.
+func truncatePrefixListChanges(c *prefixListChanges, n int) *prefixListChanges {
+	if c.len() <= n {
+		return c
+	}
+	if len(c.remove) >= n {
+		return &prefixListChanges{remove: c.remove[:n]}
+	}
+	return &prefixListChanges{
+		add:    c.add[:n-len(c.remove)],
+		remove: c.remove,
+	}
+}
+
+func (s *streamer) reconcilePrefixList(ctx context.Context, c *PrefixListConfig, desired mapset.Set, descriptions map[string]string, dryRun bool) (ReconcileDiff, error) {
+	target := c.String()
+	diff := ReconcileDiff{Target: target}
+	var computed bool
+	err := s.modifyPrefixList(ctx, c, func(entries map[string]string) *prefixListChanges {
+		current := mapset.NewSet()
+		for cidr := range entries {
+			current.Add(cidr)
+		}
+		d := newReconcileDiff(target, desired, current)
+		if !computed {
+			// report the first differences (large changes are applied in multiple calls)
+			diff, computed = d, true
+			log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+		}
+		changes := &prefixListChanges{}
+		if dryRun {
+			return changes
+		}
+		for _, cidr := range d.Add {
+			changes.add = append(changes.add, &ec2.AddPrefixListEntry{
+				Cidr:        aws.String(cidr),
+				Description: aws.String(descriptions[cidr]),
+			})
+		}
+		for _, cidr := range d.Remove {
+			changes.remove = append(changes.remove, &ec2.RemovePrefixListEntry{
+				Cidr: aws.String(cidr),
+			})
+		}
+		return changes
+	})
+	if err != nil {
+		return diff, errors.Wrapf(err, "failed to reconcile %s", target)
+	}
+	return diff, nil
+}
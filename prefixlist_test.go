@@ -0,0 +1,219 @@
+package knockrd_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fujiwara/knockrd"
+)
+
+type fakePrefixList struct {
+	version    int64
+	maxEntries int64
+	entries    map[string]string
+	mismatches int // number of version mismatches emulating modifications by others
+}
+
+func (f *fakeEC2) DescribeManagedPrefixLists(in *ec2.DescribeManagedPrefixListsInput) (*ec2.DescribeManagedPrefixListsOutput, error) {
+	out := &ec2.DescribeManagedPrefixListsOutput{}
+	for _, id := range in.PrefixListIds {
+		if pl, ok := f.prefixLists[aws.StringValue(id)]; ok {
+			out.PrefixLists = append(out.PrefixLists, &ec2.ManagedPrefixList{
+				PrefixListId: id,
+				Version:      aws.Int64(pl.version),
+				MaxEntries:   aws.Int64(pl.maxEntries),
+				State:        aws.String("modify-complete"),
+			})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) GetManagedPrefixListEntriesPages(in *ec2.GetManagedPrefixListEntriesInput, fn func(*ec2.GetManagedPrefixListEntriesOutput, bool) bool) error {
+	pl := f.prefixLists[aws.StringValue(in.PrefixListId)]
+	out := &ec2.GetManagedPrefixListEntriesOutput{}
+	for cidr, description := range pl.entries {
+		out.Entries = append(out.Entries, &ec2.PrefixListEntry{Cidr: aws.String(cidr), Description: aws.String(description)})
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *fakeEC2) ModifyManagedPrefixList(in *ec2.ModifyManagedPrefixListInput) (*ec2.ModifyManagedPrefixListOutput, error) {
+	pl := f.prefixLists[aws.StringValue(in.PrefixListId)]
+	var add, remove []string
+	for _, e := range in.AddEntries {
+		add = append(add, aws.StringValue(e.Cidr))
+	}
+	for _, e := range in.RemoveEntries {
+		remove = append(remove, aws.StringValue(e.Cidr))
+	}
+	f.calls = append(f.calls, fmt.Sprintf("modify version:%d add:%s remove:%s", aws.Int64Value(in.CurrentVersion), strings.Join(add, ","), strings.Join(remove, ",")))
+	if pl.mismatches > 0 {
+		pl.mismatches--
+		pl.version++
+		return nil, awserr.New("PrefixListVersionMismatch", "the version is mismatched", nil)
+	}
+	if aws.Int64Value(in.CurrentVersion) != pl.version {
+		return nil, awserr.New("PrefixListVersionMismatch", "the version is mismatched", nil)
+	}
+	for _, e := range in.RemoveEntries {
+		delete(pl.entries, aws.StringValue(e.Cidr))
+	}
+	for _, e := range in.AddEntries {
+		pl.entries[aws.StringValue(e.Cidr)] = aws.StringValue(e.Description)
+	}
+	pl.version++
+	return &ec2.ModifyManagedPrefixListOutput{}, nil
+}
+
+func (pl *fakePrefixList) cidrs() []string {
+	var cidrs []string
+	for cidr := range pl.entries {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+func cidrsOf(prefix string, n int) []string {
+	var cidrs []string
+	for i := 0; i < n; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("%s.%d/32", prefix, i))
+	}
+	return cidrs
+}
+
+func TestTruncatePrefixListChanges(t *testing.T) {
+	for _, tc := range []struct {
+		add, remove       int
+		expectedAdd       int
+		expectedRemove    int
+		expectedAddPrefix string
+	}{
+		{add: 3, remove: 2, expectedAdd: 3, expectedRemove: 2},
+		{add: 150, remove: 0, expectedAdd: 100, expectedRemove: 0},
+		{add: 80, remove: 50, expectedAdd: 50, expectedRemove: 50},
+		{add: 10, remove: 120, expectedAdd: 0, expectedRemove: 100},
+	} {
+		add, remove := knockrd.TruncatePrefixListChanges(cidrsOf("192.0.2", tc.add), cidrsOf("198.51.100", tc.remove), 100)
+		if len(add) != tc.expectedAdd || len(remove) != tc.expectedRemove {
+			t.Errorf("add:%d remove:%d is truncated to add:%d remove:%d", tc.add, tc.remove, len(add), len(remove))
+		}
+		// in order
+		for i, cidr := range add {
+			if cidr != fmt.Sprintf("192.0.2.%d/32", i) {
+				t.Errorf("unexpected cidr %s at %d", cidr, i)
+			}
+		}
+	}
+}
+
+func prefixListEvent(t *testing.T, records ...string) events.DynamoDBEvent {
+	t.Helper()
+	var ev events.DynamoDBEvent
+	for i, r := range records {
+		p := strings.SplitN(r, " ", 2)
+		ev.Records = append(ev.Records, events.DynamoDBEventRecord{
+			EventName: p[0],
+			Change: events.DynamoDBStreamRecord{
+				Keys:           map[string]events.DynamoDBAttributeValue{"Key": events.NewStringAttribute(p[1])},
+				SequenceNumber: fmt.Sprint(i + 1),
+				NewImage: map[string]events.DynamoDBAttributeValue{
+					"Key":      events.NewStringAttribute(p[1]),
+					"Identity": events.NewStringAttribute("foo@example.com"),
+					"Expires":  events.NewNumberAttribute("1893456000"), // 2030-01-01
+				},
+			},
+		})
+	}
+	return ev
+}
+
+func TestPrefixList(t *testing.T) {
+	client := newFakeEC2()
+	pl := &fakePrefixList{
+		version:    3,
+		maxEntries: 10,
+		entries: map[string]string{
+			"198.51.100.1/32": "knockrd identity:foo@example.com expires:2029-01-01T00:00:00Z",
+			"198.51.100.2/32": "knockrd identity:foo@example.com expires:2030-01-01T00:00:00Z",
+			"198.51.100.3/32": "knockrd identity:bar@example.com expires:2029-01-01T00:00:00Z",
+		},
+		mismatches: 1,
+	}
+	client.prefixLists["pl-1"] = pl
+	conf := &knockrd.Config{
+		TTL:         time.Hour,
+		PrefixLists: knockrd.PrefixListsConfig{V4: []*knockrd.PrefixListConfig{{ID: "pl-1"}}},
+	}
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	handler := knockrd.NewStreamHandlerWithEC2(conf, b, client)
+	ev := prefixListEvent(t,
+		"INSERT 198.51.100.4", // added
+		"MODIFY 198.51.100.1", // extended
+		"MODIFY 198.51.100.2", // up to date
+		"REMOVE 198.51.100.3", // removed
+	)
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	// retried with the new version
+	expected := []string{
+		"modify version:3 add:198.51.100.4/32,198.51.100.1/32 remove:198.51.100.3/32",
+		"modify version:4 add:198.51.100.4/32,198.51.100.1/32 remove:198.51.100.3/32",
+	}
+	if strings.Join(client.calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected calls %#v", client.calls)
+	}
+	if cidrs := strings.Join(pl.cidrs(), ","); cidrs != "198.51.100.1/32,198.51.100.2/32,198.51.100.4/32" {
+		t.Errorf("unexpected entries %s", cidrs)
+	}
+	if d := pl.entries["198.51.100.1/32"]; d != "knockrd identity:foo@example.com expires:2030-01-01T00:00:00Z" {
+		t.Errorf("the description is not refreshed %s", d)
+	}
+}
+
+func TestPrefixListMaxEntries(t *testing.T) {
+	client := newFakeEC2()
+	pl := &fakePrefixList{
+		version:    1,
+		maxEntries: 2,
+		entries:    map[string]string{"198.51.100.1/32": "knockrd"},
+	}
+	client.prefixLists["pl-1"] = pl
+	conf := &knockrd.Config{
+		TTL:         time.Hour,
+		PrefixLists: knockrd.PrefixListsConfig{V4: []*knockrd.PrefixListConfig{{ID: "pl-1"}}},
+	}
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	handler := knockrd.NewStreamHandlerWithEC2(conf, b, client)
+
+	// records are applied one by one until the list is full
+	res, err := knockrd.NewBatchItemFailuresHandler(handler)(context.Background(), prefixListEvent(t, "INSERT 198.51.100.2", "INSERT 198.51.100.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.BatchItemFailures) != 1 || res.BatchItemFailures[0].ItemIdentifier != "2" {
+		t.Errorf("unexpected batch item failures %#v", res.BatchItemFailures)
+	}
+	if cidrs := strings.Join(pl.cidrs(), ","); cidrs != "198.51.100.1/32,198.51.100.2/32" {
+		t.Errorf("unexpected entries %s", cidrs)
+	}
+
+	// removals make room for additions
+	if err := handler(context.Background(), prefixListEvent(t, "REMOVE 198.51.100.1", "INSERT 198.51.100.3")); err != nil {
+		t.Fatal(err)
+	}
+	if cidrs := strings.Join(pl.cidrs(), ","); cidrs != "198.51.100.2/32,198.51.100.3/32" {
+		t.Errorf("unexpected entries %s", cidrs)
+	}
+}
@@ -0,0 +1,329 @@
+package knockrd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/pkg/errors"
+)
+
+// ReconcileDiff represents differences between the backend and a target.
+type ReconcileDiff struct {
+	Target string
+	Add    []string
+	Remove []string
+}
+
+func (d ReconcileDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n", d.Target)
+	for _, cidr := range d.Add {
+		fmt.Fprintf(&b, "+ %s\n", cidr)
+	}
+	for _, cidr := range d.Remove {
+		fmt.Fprintf(&b, "- %s\n", cidr)
+	}
+	return b.String()
+}
+
+// IsEmpty returns true if the target has no differences.
+func (d ReconcileDiff) IsEmpty() bool {
+	return len(d.Add) == 0 && len(d.Remove) == 0
+}
+
+func newReconcileDiff(target string, desired, current mapset.Set) ReconcileDiff {
+	return ReconcileDiff{
+		Target: target,
+		Add:    sortedStrings(desired.Difference(current)),
+		Remove: sortedStrings(current.Difference(desired)),
+	}
+}
+
+func sortedStrings(s mapset.Set) []string {
+	var res []string
+	for _, v := range s.ToSlice() {
+		res = append(res, v.(string))
+	}
+	sort.Strings(res)
+	return res
+}
+
+// NewReconcileHandler creates a handler function for reconciliation by scheduled events.
+func NewReconcileHandler(conf *Config) (func(context.Context, events.CloudWatchEvent) error, error) {
+	b, err := NewDynamoDBBackend(conf)
+	if err != nil {
+		return nil, err
+	}
+	s := newStreamer(conf)
+	return func(ctx context.Context, _ events.CloudWatchEvent) error {
+		_, err := s.Reconcile(ctx, b, conf.DryRun)
+		return err
+	}, nil
+}
+
+// Reconcile reconciles targets with active allowances in the backend.
+// IP sets, prefix lists, security groups, network ACLs, HAProxy, Kubernetes and Cloudflare lists are reconciled.
+// The local firewall, allow-list files, Consul, etcd and webhooks are not.
+func Reconcile(ctx context.Context, conf *Config) ([]ReconcileDiff, error) {
+	b, err := NewDynamoDBBackend(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamer(conf).Reconcile(ctx, b, conf.DryRun)
+}
+
+// Reconcile computes the desired set of addresses from the backend and applies them to targets.
+func (s *streamer) Reconcile(ctx context.Context, b Backend, dryRun bool) ([]ReconcileDiff, error) {
+	items, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	v4, v6 := mapset.NewSet(), mapset.NewSet()
+	descriptions := make(map[string]string, len(items))
+	active := make([]ipSetEvent, 0, len(items))
+	for _, item := range items {
+		ev := newIPSetEvent(item.Key, true)
+		if ev == nil || ev.service != s.service {
+			continue
+		}
+		ev.identity = item.Identity
+		if item.Expires > 0 {
+			ev.expires = time.Unix(item.Expires, 0)
+		}
+		descriptions[ev.CIDR()] = securityGroupRuleDescription(*ev)
+		active = append(active, *ev)
+		if ev.v4 {
+			v4.Add(ev.CIDR())
+		} else {
+			v6.Add(ev.CIDR())
+		}
+	}
+	if s.service != "" {
+		log.Printf("[info] reconcile %d IPv4 and %d IPv6 addresses for service %s (dry-run=%t)", v4.Cardinality(), v6.Cardinality(), s.service, dryRun)
+	} else {
+		log.Printf("[info] reconcile %d IPv4 and %d IPv6 addresses (dry-run=%t)", v4.Cardinality(), v6.Cardinality(), dryRun)
+	}
+
+	var diffs []ReconcileDiff
+	for _, t := range []struct {
+		ipsets  []*IPSetConfig
+		desired mapset.Set
+	}{
+		{s.conf.IPSets.V4, v4},
+		{s.conf.IPSets.V6, v6},
+	} {
+		for _, c := range t.ipsets {
+			if c.ID == "" {
+				continue
+			}
+			ds, err := s.reconcileIPSetChain(ctx, c, t.desired, dryRun)
+			diffs = append(diffs, ds...)
+			if err != nil {
+				return diffs, err
+			}
+		}
+	}
+	for _, t := range []struct {
+		lists   []*PrefixListConfig
+		desired mapset.Set
+	}{
+		{s.conf.PrefixLists.V4, v4},
+		{s.conf.PrefixLists.V6, v6},
+	} {
+		for _, c := range t.lists {
+			diff, err := s.reconcilePrefixList(ctx, c, t.desired, descriptions, dryRun)
+			if err != nil {
+				return diffs, err
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	desired := v4.Union(v6)
+	for _, gc := range s.conf.SecurityGroups {
+		ds, err := s.reconcileSecurityGroupChain(gc, desired, descriptions, dryRun)
+		diffs = append(diffs, ds...)
+		if err != nil {
+			return diffs, err
+		}
+	}
+	for _, c := range s.conf.NetworkACLs {
+		diff, err := s.reconcileNetworkACL(c, desired, dryRun)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	for _, c := range s.conf.HAProxy {
+		diff, err := s.reconcileHAProxy(ctx, c, desired, dryRun)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	if s.conf.Kubernetes != nil {
+		ds, err := s.reconcileKubernetes(ctx, s.conf.Kubernetes, desired, dryRun)
+		diffs = append(diffs, ds...)
+		if err != nil {
+			return diffs, err
+		}
+	}
+	for _, c := range s.conf.CloudflareLists {
+		diff, err := s.reconcileCloudflareList(ctx, c, active, dryRun)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	for _, ss := range s.serviceStreamers() {
+		ds, err := ss.Reconcile(ctx, b, dryRun)
+		diffs = append(diffs, ds...)
+		if err != nil {
+			return diffs, err
+		}
+	}
+	return diffs, nil
+}
+
+// reconcileIPSetChain distributes desired addresses to the IP set and its spillover IP sets, and reconciles them.
+// Addresses already in one of the IP sets are kept in it.
+func (s *streamer) reconcileIPSetChain(ctx context.Context, c *IPSetConfig, desired mapset.Set, dryRun bool) ([]ReconcileDiff, error) {
+	chain := c.chain()
+	buckets := make([]*capacityBucket, 0, len(chain))
+	current := mapset.NewSet()
+	for _, ic := range chain {
+		_, addrs, _, err := s.getIPSet(ic)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get %s", ic)
+		}
+		current = current.Union(addrs)
+		buckets = append(buckets, newCapacityBucket(ic.String(), ic.maxEntries(), 1, addrs.Cardinality(), addrs, addrs.Clone()))
+	}
+	unplaced, err := s.newCapacityPlanner(buckets, false).place(
+		sortedStrings(desired.Difference(current)),
+		sortedStrings(current.Difference(desired)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []ReconcileDiff
+	for i, b := range buckets {
+		diff, err := s.reconcileIPSet(ctx, chain[i], b.entries, dryRun)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, capacityError(buckets, unplaced)
+}
+
+func (s *streamer) reconcileIPSet(ctx context.Context, c *IPSetConfig, desired mapset.Set, dryRun bool) (ReconcileDiff, error) {
+	target := c.String()
+	diff := ReconcileDiff{Target: target}
+	err := s.modifyIPSet(ctx, c, func(addrs mapset.Set) bool {
+		diff = newReconcileDiff(target, desired, addrs)
+		if diff.IsEmpty() {
+			log.Printf("[info] %s is up to date", target)
+			return false
+		}
+		log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+		if dryRun {
+			return false
+		}
+		addrs.Clear()
+		for _, ad := range desired.ToSlice() {
+			addrs.Add(ad)
+		}
+		return true
+	})
+	if err != nil {
+		return diff, errors.Wrapf(err, "failed to reconcile %s", target)
+	}
+	return diff, nil
+}
+
+// reconcileSecurityGroupChain distributes desired addresses to the security group and its spillover security groups, and reconciles them.
+// Addresses already in one of the security groups are kept in it.
+func (s *streamer) reconcileSecurityGroupChain(gc *SecurityGroupConfig, desired mapset.Set, descriptions map[string]string, dryRun bool) ([]ReconcileDiff, error) {
+	pcs := gc.portConfigs()
+	states, err := s.describeSecurityGroupStates(gc, pcs)
+	if err != nil {
+		return nil, err
+	}
+	placed := make([]mapset.Set, len(states))
+	for i := range placed {
+		placed[i] = mapset.NewSet()
+	}
+	var capErr error
+	for _, v4 := range []bool{true, false} {
+		chain := make([]*capacityBucket, 0, len(states))
+		current, managed := mapset.NewSet(), mapset.NewSet()
+		for _, st := range states {
+			b := st.bucket(gc, len(pcs), v4)
+			current = current.Union(b.entries)
+			managed = managed.Union(b.managed)
+			chain = append(chain, b)
+		}
+		want := mapset.NewSet()
+		for _, v := range desired.ToSlice() {
+			if strings.Contains(v.(string), ":") != v4 {
+				want.Add(v)
+			}
+		}
+		unplaced, err := s.newCapacityPlanner(chain, false).place(
+			sortedStrings(want.Difference(current)),
+			sortedStrings(managed.Difference(want)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := capacityError(chain, unplaced); err != nil {
+			capErr = err
+		}
+		for i, b := range chain {
+			placed[i] = placed[i].Union(b.entries.Intersect(want))
+		}
+	}
+	var diffs []ReconcileDiff
+	for i, st := range states {
+		for _, pc := range pcs {
+			diff, err := s.reconcileSecurityGroup(st.id, pc, placed[i], descriptions, dryRun)
+			if err != nil {
+				return diffs, err
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, capErr
+}
+
+func (s *streamer) reconcileSecurityGroup(id string, pc *PortConfig, desired mapset.Set, descriptions map[string]string, dryRun bool) (ReconcileDiff, error) {
+	target := fmt.Sprintf("security-group id:%s %s", id, pc)
+	managed, all, err := s.describeSecurityGroupRanges(id, pc)
+	if err != nil {
+		return ReconcileDiff{Target: target}, err
+	}
+	diff := ReconcileDiff{
+		Target: target,
+		Add:    sortedStrings(desired.Difference(all)),
+		Remove: sortedStrings(managed.Difference(desired)),
+	}
+	if diff.IsEmpty() {
+		log.Printf("[info] %s is up to date", target)
+		return diff, nil
+	}
+	log.Printf("[info] %s add:%v remove:%v", target, diff.Add, diff.Remove)
+	if dryRun {
+		return diff, nil
+	}
+
+	if err := s.modifySecurityGroup(id, pc, diff.Add, diff.Remove, descriptions); err != nil {
+		return diff, err
+	}
+	return diff, nil
+}
@@ -0,0 +1,116 @@
+package knockrd_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/knockrd"
+)
+
+func TestReconcileDiffString(t *testing.T) {
+	d := knockrd.ReconcileDiff{
+		Target: "ip-set id:xxx",
+		Add:    []string{"198.51.100.1/32", "2001:db8::1/128"},
+		Remove: []string{"198.51.100.2/32"},
+	}
+	expected := `--- ip-set id:xxx
++ 198.51.100.1/32
++ 2001:db8::1/128
+- 198.51.100.2/32
+`
+	if s := d.String(); s != expected {
+		t.Errorf("unexpected diff %s", s)
+	}
+	if d.IsEmpty() {
+		t.Error("diff must not be empty")
+	}
+	if !(knockrd.ReconcileDiff{Target: "x"}).IsEmpty() {
+		t.Error("diff must be empty")
+	}
+}
+
+func testReconcileBackend(t *testing.T) knockrd.Backend {
+	t.Helper()
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	for _, key := range []string{"198.51.100.1", "198.51.100.3", "2001:db8::1"} {
+		if err := b.Set(knockrd.Item{Key: key, Identity: "foo@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func TestReconcileSecurityGroup(t *testing.T) {
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		SecurityGroups: []*knockrd.SecurityGroupConfig{
+			{ID: "sg-1", FromPort: 22, ToPort: 22, Protocol: "tcp"},
+		},
+	}
+	for _, dryRun := range []bool{true, false} {
+		client := newFakeEC2()
+		client.addRule("sg-1", "192.0.2.0/24", "office")
+		client.addRule("sg-1", "198.51.100.9/32", "ops")
+		client.addRule("sg-1", "198.51.100.1/32", "knockrd identity:foo@example.com")
+		client.addRule("sg-1", "198.51.100.2/32", "knockrd identity:bar@example.com")
+
+		diffs, err := knockrd.ReconcileWithClients(context.Background(), conf, testReconcileBackend(t), client, nil, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffs) != 1 {
+			t.Fatalf("unexpected diffs %#v", diffs)
+		}
+		// foreign rules are never removed
+		if a, r := strings.Join(diffs[0].Add, ","), strings.Join(diffs[0].Remove, ","); a != "198.51.100.3/32,2001:db8::1/128" || r != "198.51.100.2/32" {
+			t.Errorf("unexpected diff %s", diffs[0])
+		}
+		cidrs := client.cidrs("sg-1")
+		sort.Strings(cidrs)
+		expected := "192.0.2.0/24,198.51.100.1/32,198.51.100.3/32,198.51.100.9/32,2001:db8::1/128"
+		if dryRun {
+			expected = "192.0.2.0/24,198.51.100.1/32,198.51.100.2/32,198.51.100.9/32"
+			if len(client.calls) > 0 {
+				t.Errorf("must not be modified in dry-run %#v", client.calls)
+			}
+		}
+		if c := strings.Join(cidrs, ","); c != expected {
+			t.Errorf("unexpected rules %s (dry-run=%t)", c, dryRun)
+		}
+	}
+}
+
+func TestReconcileIPSet(t *testing.T) {
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		IPSets: knockrd.IPSetsConfig{
+			V4: []*knockrd.IPSetConfig{{ID: "a", Name: "knockrd", Scope: "REGIONAL", Region: "us-east-1"}},
+		},
+	}
+	for _, dryRun := range []bool{true, false} {
+		client := &lockingWAF{addresses: []string{"192.0.2.1/32", "198.51.100.1/32"}}
+		diffs, err := knockrd.ReconcileWithClients(context.Background(), conf, testReconcileBackend(t), nil, client, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffs) != 1 {
+			t.Fatalf("unexpected diffs %#v", diffs)
+		}
+		if a, r := strings.Join(diffs[0].Add, ","), strings.Join(diffs[0].Remove, ","); a != "198.51.100.3/32" || r != "192.0.2.1/32" {
+			t.Errorf("unexpected diff %s", diffs[0])
+		}
+		expected := "198.51.100.1/32,198.51.100.3/32"
+		if dryRun {
+			expected = "192.0.2.1/32,198.51.100.1/32"
+			if client.updates > 0 {
+				t.Errorf("must not be updated in dry-run %d", client.updates)
+			}
+		}
+		if a := strings.Join(client.addresses, ","); a != expected {
+			t.Errorf("unexpected addresses %s (dry-run=%t)", a, dryRun)
+		}
+	}
+}
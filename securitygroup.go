@@ -0,0 +1,476 @@
+package knockrd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapset "github.com/deckarep/golang-set"
+	"github.com/pkg/errors"
+)
+
+const (
+	ec2ErrCodeInvalidPermissionDuplicate = "InvalidPermission.Duplicate"
+	ec2ErrCodeInvalidPermissionNotFound  = "InvalidPermission.NotFound"
+
+	securityGroupDescriptionMaxLength = 255
+)
+
+// managedDescriptionPrefixes are prefixes of security group rule descriptions written by knockrd.
+var managedDescriptionPrefixes = []string{
+	"knockrd ",
+	"by lambda function ", // older versions
+}
+
+func (s *streamer) updateSecurityGroup(groups []*SecurityGroupConfig, v4Events []ipSetEvent, v6Events []ipSetEvent) error {
+	// the last event for each address wins
+	evs := latestEvents(v4Events, v6Events)
+	if len(evs) == 0 {
+		return nil
+	}
+	descriptions := make(map[string]string, len(evs))
+	for _, ev := range evs {
+		descriptions[ev.CIDR()] = securityGroupRuleDescription(ev)
+	}
+	for _, gc := range groups {
+		if err := s.updateSecurityGroupChain(gc, evs, descriptions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateSecurityGroupChain applies events to the security group and its spillover security groups.
+// Added addresses are authorized in the first security group which has room.
+func (s *streamer) updateSecurityGroupChain(gc *SecurityGroupConfig, evs []ipSetEvent, descriptions map[string]string) error {
+	pcs := gc.portConfigs()
+	states, err := s.describeSecurityGroupStates(gc, pcs)
+	if err != nil {
+		return err
+	}
+	buckets := make(map[string]*capacityBucket) // by security group ID + address family
+	for _, v4 := range []bool{true, false} {
+		var add, remove []string
+		for _, ev := range evs {
+			if ev.v4 != v4 {
+				continue
+			}
+			if ev.add {
+				add = append(add, ev.CIDR())
+			} else {
+				remove = append(remove, ev.CIDR())
+			}
+		}
+		if len(add)+len(remove) == 0 {
+			continue
+		}
+		chain := make([]*capacityBucket, 0, len(states))
+		for _, st := range states {
+			b := st.bucket(gc, len(pcs), v4)
+			buckets[fmt.Sprintf("%s %t", st.id, v4)] = b
+			chain = append(chain, b)
+		}
+		unplaced, err := s.newCapacityPlanner(chain, true).place(add, remove)
+		if err != nil {
+			return err
+		}
+		reportUnplaced(chain, unplaced)
+	}
+
+	for _, st := range states {
+		for i, pc := range pcs {
+			var add, remove, update []string
+			for _, ev := range evs {
+				cidr := ev.CIDR()
+				b := buckets[fmt.Sprintf("%s %t", st.id, ev.v4)]
+				if ev.add {
+					if b == nil || !b.entries.Contains(cidr) {
+						continue
+					}
+					if st.managed[i].Contains(cidr) {
+						if !ev.expires.IsZero() {
+							update = append(update, cidr)
+						}
+						continue
+					}
+					if st.all[i].Contains(cidr) {
+						log.Printf("[debug] %s is already authorized in security group(%s)", cidr, st.id)
+						continue
+					}
+					add = append(add, cidr)
+				} else {
+					if !st.managed[i].Contains(cidr) {
+						log.Printf("[debug] %s is not authorized by knockrd in security group(%s)", cidr, st.id)
+						continue
+					}
+					remove = append(remove, cidr)
+				}
+			}
+			// revoke rules evicted by the capacity planner
+			for _, v4 := range []bool{true, false} {
+				b := buckets[fmt.Sprintf("%s %t", st.id, v4)]
+				if b == nil {
+					continue
+				}
+				for _, cidr := range b.remove {
+					if st.managed[i].Contains(cidr) && !containsString(remove, cidr) {
+						remove = append(remove, cidr)
+					}
+				}
+			}
+			if err := s.modifySecurityGroup(st.id, pc, add, remove, descriptions); err != nil {
+				return err
+			}
+			if err := s.updateSecurityGroupRuleDescriptions(st.id, pc, update, descriptions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// modifySecurityGroup authorizes and revokes ingress rules for CIDRs.
+// Duplicated rules on authorizing and missing rules on revoking are not treated as errors.
+func (s *streamer) modifySecurityGroup(id string, pc *PortConfig, add, remove []string, descriptions map[string]string) error {
+	if len(add) > 0 {
+		authorize := pc.ipPermission()
+		setIPPermissionRanges(authorize, add, descriptions)
+		if err := s.authorizeSecurityGroupIngress(id, authorize); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		revoke := pc.ipPermission()
+		setIPPermissionRanges(revoke, remove, nil)
+		if err := s.revokeSecurityGroupIngress(id, revoke); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *streamer) authorizeSecurityGroupIngress(id string, perm *ec2.IpPermission) error {
+	if s.skipByDryRun("authorize security group(%s) %s", id, JSONString(perm)) {
+		return nil
+	}
+	log.Printf("[debug] authorizing security group(%s) %s", id, JSONString(perm))
+	_, err := s.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(id),
+		IpPermissions: []*ec2.IpPermission{perm},
+	})
+	if isAWSErrorCode(err, ec2ErrCodeInvalidPermissionDuplicate) {
+		if len(perm.IpRanges)+len(perm.Ipv6Ranges) == 1 {
+			log.Printf("[info] security group(%s) already has %s", id, JSONString(perm))
+			return nil
+		}
+		// some of ranges are duplicated. authorize one by one
+		for _, p := range splitIPPermission(perm) {
+			if err := s.authorizeSecurityGroupIngress(id, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to AuthorizeSecurityGroupIngress for %s", id)
+	}
+	log.Printf("[info] authorized security group(%s) %s", id, JSONString(perm))
+	return nil
+}
+
+func (s *streamer) revokeSecurityGroupIngress(id string, perm *ec2.IpPermission) error {
+	if s.skipByDryRun("revoke security group(%s) %s", id, JSONString(perm)) {
+		return nil
+	}
+	log.Printf("[debug] revoking security group(%s) %s", id, JSONString(perm))
+	_, err := s.ec2.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+		GroupId:       aws.String(id),
+		IpPermissions: []*ec2.IpPermission{perm},
+	})
+	if isAWSErrorCode(err, ec2ErrCodeInvalidPermissionNotFound) {
+		if len(perm.IpRanges)+len(perm.Ipv6Ranges) == 1 {
+			log.Printf("[info] security group(%s) does not have %s", id, JSONString(perm))
+			return nil
+		}
+		// some of ranges are missing. revoke one by one
+		for _, p := range splitIPPermission(perm) {
+			if err := s.revokeSecurityGroupIngress(id, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to RevokeSecurityGroupIngress for %s", id)
+	}
+	log.Printf("[info] revoked security group(%s) %s", id, JSONString(perm))
+	return nil
+}
+
+// updateSecurityGroupRuleDescriptions updates descriptions of existing rules (e.g. extended expiry).
+func (s *streamer) updateSecurityGroupRuleDescriptions(id string, pc *PortConfig, cidrs []string, descriptions map[string]string) error {
+	if len(cidrs) == 0 {
+		return nil
+	}
+	perm := pc.ipPermission()
+	setIPPermissionRanges(perm, cidrs, descriptions)
+	if s.skipByDryRun("update descriptions of security group(%s) %s", id, JSONString(perm)) {
+		return nil
+	}
+	log.Printf("[debug] updating descriptions of security group(%s) %s", id, JSONString(perm))
+	_, err := s.ec2.UpdateSecurityGroupRuleDescriptionsIngress(&ec2.UpdateSecurityGroupRuleDescriptionsIngressInput{
+		GroupId:       aws.String(id),
+		IpPermissions: []*ec2.IpPermission{perm},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to UpdateSecurityGroupRuleDescriptionsIngress for %s", id)
+	}
+	log.Printf("[info] updated descriptions of security group(%s) %s", id, JSONString(perm))
+	return nil
+}
+
+// securityGroupState represents ranges of ingress rules in a security group.
+type securityGroupState struct {
+	id      string
+	managed []mapset.Set // CIDRs of rules written by knockrd for each port config
+	all     []mapset.Set // all of CIDRs for each port config
+	rulesV4 int          // number of IPv4 ingress rules of all ports
+	rulesV6 int          // number of IPv6 ingress rules of all ports
+}
+
+// describeSecurityGroupStates returns states of the security group and its spillover security groups.
+func (s *streamer) describeSecurityGroupStates(gc *SecurityGroupConfig, pcs []*PortConfig) ([]*securityGroupState, error) {
+	ids := append([]string{gc.ID}, gc.Spillover...)
+	states := make([]*securityGroupState, 0, len(ids))
+	for _, id := range ids {
+		sg, err := s.describeSecurityGroup(id)
+		if err != nil {
+			return nil, err
+		}
+		st := &securityGroupState{id: id}
+		for _, pc := range pcs {
+			managed, all := securityGroupRanges(sg, pc)
+			st.managed = append(st.managed, managed)
+			st.all = append(st.all, all)
+		}
+		for _, perm := range sg.IpPermissions {
+			st.rulesV4 += len(perm.IpRanges)
+			st.rulesV6 += len(perm.Ipv6Ranges)
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// bucket returns a capacity bucket of the security group for the address family.
+// An address uses a rule for each port config.
+func (st *securityGroupState) bucket(gc *SecurityGroupConfig, ports int, v4 bool) *capacityBucket {
+	entries, managed := mapset.NewSet(), mapset.NewSet()
+	for i := range st.all {
+		for _, v := range st.all[i].ToSlice() {
+			if strings.Contains(v.(string), ":") != v4 {
+				entries.Add(v)
+			}
+		}
+		for _, v := range st.managed[i].ToSlice() {
+			if strings.Contains(v.(string), ":") != v4 {
+				managed.Add(v)
+			}
+		}
+	}
+	name, used := fmt.Sprintf("security-group id:%s IPv4", st.id), st.rulesV4
+	if !v4 {
+		name, used = fmt.Sprintf("security-group id:%s IPv6", st.id), st.rulesV6
+	}
+	return newCapacityBucket(name, gc.maxRules(), ports, used, entries, managed)
+}
+
+func (gc *SecurityGroupConfig) maxRules() int {
+	if gc.MaxRules > 0 {
+		return gc.MaxRules
+	}
+	return DefaultSecurityGroupMaxRules
+}
+
+func (s *streamer) describeSecurityGroup(id string) (*ec2.SecurityGroup, error) {
+	res, err := s.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to DescribeSecurityGroups for %s", id)
+	}
+	if len(res.SecurityGroups) == 0 {
+		return nil, errors.Errorf("security group %s is not found", id)
+	}
+	return res.SecurityGroups[0], nil
+}
+
+// describeSecurityGroupRanges returns CIDRs of the ingress rules matched with the port config.
+// managed contains CIDRs of rules written by knockrd, all contains all of CIDRs.
+func (s *streamer) describeSecurityGroupRanges(id string, pc *PortConfig) (managed mapset.Set, all mapset.Set, err error) {
+	sg, err := s.describeSecurityGroup(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	managed, all = securityGroupRanges(sg, pc)
+	log.Printf("[debug] security group(%s) %s managed:%s all:%s", id, pc, managed, all)
+	return managed, all, nil
+}
+
+func securityGroupRanges(sg *ec2.SecurityGroup, pc *PortConfig) (managed mapset.Set, all mapset.Set) {
+	managed, all = mapset.NewSet(), mapset.NewSet()
+	for _, perm := range sg.IpPermissions {
+		if !pc.matchIPPermission(perm) {
+			continue
+		}
+		for _, r := range perm.IpRanges {
+			all.Add(aws.StringValue(r.CidrIp))
+			if isManagedDescription(aws.StringValue(r.Description)) {
+				managed.Add(aws.StringValue(r.CidrIp))
+			}
+		}
+		for _, r := range perm.Ipv6Ranges {
+			all.Add(aws.StringValue(r.CidrIpv6))
+			if isManagedDescription(aws.StringValue(r.Description)) {
+				managed.Add(aws.StringValue(r.CidrIpv6))
+			}
+		}
+	}
+	return managed, all
+}
+
+func isManagedDescription(d string) bool {
+	for _, prefix := range managedDescriptionPrefixes {
+		if strings.HasPrefix(d, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setIPPermissionRanges appends ranges of the CIDRs to the permission.
+// descriptions may be nil (for revoking).
+func setIPPermissionRanges(perm *ec2.IpPermission, cidrs []string, descriptions map[string]string) {
+	for _, cidr := range cidrs {
+		var description *string
+		if d, ok := descriptions[cidr]; ok {
+			description = aws.String(d)
+		}
+		if strings.Contains(cidr, ":") {
+			perm.Ipv6Ranges = append(perm.Ipv6Ranges, &ec2.Ipv6Range{
+				CidrIpv6:    aws.String(cidr),
+				Description: description,
+			})
+		} else {
+			perm.IpRanges = append(perm.IpRanges, &ec2.IpRange{
+				CidrIp:      aws.String(cidr),
+				Description: description,
+			})
+		}
+	}
+}
+
+// splitIPPermission splits the permission into permissions which have a single range.
+func splitIPPermission(perm *ec2.IpPermission) []*ec2.IpPermission {
+	var perms []*ec2.IpPermission
+	for _, r := range perm.IpRanges {
+		p := &ec2.IpPermission{
+			FromPort:   perm.FromPort,
+			ToPort:     perm.ToPort,
+			IpProtocol: perm.IpProtocol,
+			IpRanges:   []*ec2.IpRange{r},
+		}
+		perms = append(perms, p)
+	}
+	for _, r := range perm.Ipv6Ranges {
+		p := &ec2.IpPermission{
+			FromPort:   perm.FromPort,
+			ToPort:     perm.ToPort,
+			IpProtocol: perm.IpProtocol,
+			Ipv6Ranges: []*ec2.Ipv6Range{r},
+		}
+		perms = append(perms, p)
+	}
+	return perms
+}
+
+func isAWSErrorCode(err error, code string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == code
+	}
+	return false
+}
+
+// securityGroupRuleDescription returns a description of the rule for the event.
+// e.g. "knockrd identity:foo@example.com expires:2020-05-01T00:00:00Z"
+func securityGroupRuleDescription(ev ipSetEvent) string {
+	d := []string{"knockrd"}
+	if ev.identity != "" {
+		d = append(d, "identity:"+sanitizeSecurityGroupDescription(ev.identity))
+	}
+	if !ev.expires.IsZero() {
+		d = append(d, "expires:"+ev.expires.UTC().Format(time.RFC3339))
+	} else {
+		d = append(d, "at:"+time.Now().UTC().Format(time.RFC3339))
+	}
+	if fn := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); fn != "" {
+		d = append(d, "by:"+sanitizeSecurityGroupDescription(fn))
+	}
+	description := strings.Join(d, " ")
+	if len(description) > securityGroupDescriptionMaxLength {
+		description = description[:securityGroupDescriptionMaxLength]
+	}
+	return description
+}
+
+// sanitizeSecurityGroupDescription replaces characters not allowed in descriptions of rules.
+// allowed: a-z, A-Z, 0-9, spaces, and ._-:/()#,@[]+=&;{}!$*
+func sanitizeSecurityGroupDescription(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case strings.ContainsRune("._-:/()#,@[]+=&;{}!$*", r):
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (gc *SecurityGroupConfig) portConfigs() []*PortConfig {
+	if gc.Protocol == "" {
+		return gc.Ports
+	}
+	pc := &PortConfig{
+		FromPort: gc.FromPort,
+		ToPort:   gc.ToPort,
+		Protocol: gc.Protocol,
+	}
+	return append([]*PortConfig{pc}, gc.Ports...)
+}
+
+func (pc *PortConfig) String() string {
+	return fmt.Sprintf("%s %d-%d", pc.Protocol, pc.FromPort, pc.ToPort)
+}
+
+func (pc *PortConfig) ipPermission() *ec2.IpPermission {
+	return &ec2.IpPermission{
+		FromPort:   aws.Int64(pc.FromPort),
+		ToPort:     aws.Int64(pc.ToPort),
+		IpProtocol: aws.String(pc.Protocol),
+	}
+}
+
+func (pc *PortConfig) matchIPPermission(p *ec2.IpPermission) bool {
+	if aws.StringValue(p.IpProtocol) != pc.Protocol {
+		return false
+	}
+	if pc.Protocol == "-1" {
+		// all traffic rules have no port range
+		return true
+	}
+	return aws.Int64Value(p.FromPort) == pc.FromPort && aws.Int64Value(p.ToPort) == pc.ToPort
+}
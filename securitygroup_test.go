@@ -0,0 +1,392 @@
+package knockrd_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/fujiwara/knockrd"
+)
+
+// fakeEC2 is an in-memory EC2 client which has security groups, network ACLs and prefix lists.
+type fakeEC2 struct {
+	ec2iface.EC2API
+	groups      map[string]*ec2.SecurityGroup
+	acls        map[string]*ec2.NetworkAcl
+	prefixLists map[string]*fakePrefixList
+	errs        map[string]error // errors returned for requests which have the CIDR
+	calls       []string
+
+	afterDescribe func() // emulates changes by other processes
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{
+		groups:      make(map[string]*ec2.SecurityGroup),
+		acls:        make(map[string]*ec2.NetworkAcl),
+		prefixLists: make(map[string]*fakePrefixList),
+		errs:        make(map[string]error),
+	}
+}
+
+// addRule adds an ingress rule for tcp 22 to the security group.
+func (f *fakeEC2) addRule(id, cidr, description string) {
+	sg, ok := f.groups[id]
+	if !ok {
+		sg = &ec2.SecurityGroup{GroupId: aws.String(id)}
+		f.groups[id] = sg
+	}
+	perm := f.permission(sg, &ec2.IpPermission{IpProtocol: aws.String("tcp"), FromPort: aws.Int64(22), ToPort: aws.Int64(22)}, true)
+	perm.IpRanges = append(perm.IpRanges, &ec2.IpRange{CidrIp: aws.String(cidr), Description: aws.String(description)})
+}
+
+// cidrs returns CIDRs of ingress rules of the security group.
+func (f *fakeEC2) cidrs(id string) []string {
+	var cidrs []string
+	for _, perm := range f.groups[id].IpPermissions {
+		for _, r := range perm.IpRanges {
+			cidrs = append(cidrs, aws.StringValue(r.CidrIp))
+		}
+		for _, r := range perm.Ipv6Ranges {
+			cidrs = append(cidrs, aws.StringValue(r.CidrIpv6))
+		}
+	}
+	return cidrs
+}
+
+func (f *fakeEC2) permission(sg *ec2.SecurityGroup, p *ec2.IpPermission, create bool) *ec2.IpPermission {
+	for _, perm := range sg.IpPermissions {
+		if aws.StringValue(perm.IpProtocol) == aws.StringValue(p.IpProtocol) &&
+			aws.Int64Value(perm.FromPort) == aws.Int64Value(p.FromPort) &&
+			aws.Int64Value(perm.ToPort) == aws.Int64Value(p.ToPort) {
+			return perm
+		}
+	}
+	if !create {
+		return nil
+	}
+	perm := &ec2.IpPermission{IpProtocol: p.IpProtocol, FromPort: p.FromPort, ToPort: p.ToPort}
+	sg.IpPermissions = append(sg.IpPermissions, perm)
+	return perm
+}
+
+func permissionCIDRs(p *ec2.IpPermission) []string {
+	var cidrs []string
+	for _, r := range p.IpRanges {
+		cidrs = append(cidrs, aws.StringValue(r.CidrIp))
+	}
+	for _, r := range p.Ipv6Ranges {
+		cidrs = append(cidrs, aws.StringValue(r.CidrIpv6))
+	}
+	return cidrs
+}
+
+func (f *fakeEC2) hasRange(perm *ec2.IpPermission, cidr string) bool {
+	if perm == nil {
+		return false
+	}
+	for _, c := range permissionCIDRs(perm) {
+		if c == cidr {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeEC2) record(action, id string, p *ec2.IpPermission) error {
+	cidrs := permissionCIDRs(p)
+	f.calls = append(f.calls, fmt.Sprintf("%s %s %s", action, id, strings.Join(cidrs, ",")))
+	for _, cidr := range cidrs {
+		if err, ok := f.errs[cidr]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeEC2) DescribeSecurityGroups(in *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	var groups []*ec2.SecurityGroup
+	for _, id := range in.GroupIds {
+		sg, ok := f.groups[aws.StringValue(id)]
+		if !ok {
+			sg = &ec2.SecurityGroup{GroupId: id}
+			f.groups[aws.StringValue(id)] = sg
+		}
+		groups = append(groups, copySecurityGroup(sg))
+	}
+	if f.afterDescribe != nil {
+		f.afterDescribe()
+	}
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: groups}, nil
+}
+
+func copySecurityGroup(sg *ec2.SecurityGroup) *ec2.SecurityGroup {
+	c := &ec2.SecurityGroup{GroupId: sg.GroupId}
+	for _, p := range sg.IpPermissions {
+		c.IpPermissions = append(c.IpPermissions, &ec2.IpPermission{
+			IpProtocol: p.IpProtocol,
+			FromPort:   p.FromPort,
+			ToPort:     p.ToPort,
+			IpRanges:   append([]*ec2.IpRange{}, p.IpRanges...),
+			Ipv6Ranges: append([]*ec2.Ipv6Range{}, p.Ipv6Ranges...),
+		})
+	}
+	return c
+}
+
+func (f *fakeEC2) AuthorizeSecurityGroupIngress(in *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	id := aws.StringValue(in.GroupId)
+	for _, p := range in.IpPermissions {
+		if err := f.record("authorize", id, p); err != nil {
+			return nil, err
+		}
+		// EC2 rejects the whole request when one of ranges is duplicated
+		perm := f.permission(f.groups[id], p, false)
+		for _, cidr := range permissionCIDRs(p) {
+			if f.hasRange(perm, cidr) {
+				return nil, awserr.New("InvalidPermission.Duplicate", "the specified rule already exists", nil)
+			}
+		}
+		perm = f.permission(f.groups[id], p, true)
+		perm.IpRanges = append(perm.IpRanges, p.IpRanges...)
+		perm.Ipv6Ranges = append(perm.Ipv6Ranges, p.Ipv6Ranges...)
+	}
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeEC2) RevokeSecurityGroupIngress(in *ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	id := aws.StringValue(in.GroupId)
+	for _, p := range in.IpPermissions {
+		if err := f.record("revoke", id, p); err != nil {
+			return nil, err
+		}
+		// EC2 rejects the whole request when one of ranges is missing
+		perm := f.permission(f.groups[id], p, false)
+		for _, cidr := range permissionCIDRs(p) {
+			if !f.hasRange(perm, cidr) {
+				return nil, awserr.New("InvalidPermission.NotFound", "the specified rule does not exist", nil)
+			}
+		}
+		revoked := strings.Join(permissionCIDRs(p), ",") + ","
+		var v4 []*ec2.IpRange
+		for _, r := range perm.IpRanges {
+			if !strings.Contains(revoked, aws.StringValue(r.CidrIp)+",") {
+				v4 = append(v4, r)
+			}
+		}
+		var v6 []*ec2.Ipv6Range
+		for _, r := range perm.Ipv6Ranges {
+			if !strings.Contains(revoked, aws.StringValue(r.CidrIpv6)+",") {
+				v6 = append(v6, r)
+			}
+		}
+		perm.IpRanges, perm.Ipv6Ranges = v4, v6
+	}
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeEC2) UpdateSecurityGroupRuleDescriptionsIngress(in *ec2.UpdateSecurityGroupRuleDescriptionsIngressInput) (*ec2.UpdateSecurityGroupRuleDescriptionsIngressOutput, error) {
+	for _, p := range in.IpPermissions {
+		if err := f.record("update", aws.StringValue(in.GroupId), p); err != nil {
+			return nil, err
+		}
+	}
+	return &ec2.UpdateSecurityGroupRuleDescriptionsIngressOutput{}, nil
+}
+
+func insertEvent(keys ...string) events.DynamoDBEvent {
+	var ev events.DynamoDBEvent
+	for i, key := range keys {
+		ev.Records = append(ev.Records, events.DynamoDBEventRecord{
+			EventName: "INSERT",
+			Change: events.DynamoDBStreamRecord{
+				Keys:           map[string]events.DynamoDBAttributeValue{"Key": events.NewStringAttribute(key)},
+				SequenceNumber: fmt.Sprint(i + 1),
+			},
+		})
+	}
+	return ev
+}
+
+func TestSecurityGroupCapacityEviction(t *testing.T) {
+	client := newFakeEC2()
+	client.addRule("sg-1", "192.0.2.0/24", "office")
+	client.addRule("sg-1", "198.51.100.1/32", "knockrd identity:old@example.com")
+	client.addRule("sg-1", "198.51.100.2/32", "knockrd identity:new@example.com")
+
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	now := time.Now()
+	b.Set(knockrd.Item{Key: "198.51.100.1", Expires: now.Add(10 * time.Minute).Unix()})
+	b.Set(knockrd.Item{Key: "198.51.100.2", Expires: now.Add(50 * time.Minute).Unix()})
+	b.Set(knockrd.Item{Key: "198.51.100.3", Expires: now.Add(time.Hour).Unix()})
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		SecurityGroups: []*knockrd.SecurityGroupConfig{
+			{ID: "sg-1", FromPort: 22, ToPort: 22, Protocol: "tcp", MaxRules: 3},
+		},
+		Capacity: knockrd.CapacityConfig{Eviction: knockrd.EvictionOldest},
+	}
+	handler := knockrd.NewStreamHandlerWithEC2(conf, b, client)
+	if err := handler(context.Background(), insertEvent("198.51.100.3")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"authorize sg-1 198.51.100.3/32",
+		"revoke sg-1 198.51.100.1/32",
+	}
+	if strings.Join(client.calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected calls %#v", client.calls)
+	}
+	if cidrs := strings.Join(client.cidrs("sg-1"), ","); cidrs != "192.0.2.0/24,198.51.100.2/32,198.51.100.3/32" {
+		t.Errorf("unexpected rules %s", cidrs)
+	}
+	if ok, _ := b.Get("198.51.100.1"); ok {
+		t.Error("evicted allowance must be deleted from the backend")
+	}
+}
+
+func TestSplitIPPermission(t *testing.T) {
+	perm := &ec2.IpPermission{
+		IpProtocol: aws.String("tcp"),
+		FromPort:   aws.Int64(443),
+		ToPort:     aws.Int64(443),
+		IpRanges: []*ec2.IpRange{
+			{CidrIp: aws.String("198.51.100.1/32"), Description: aws.String("knockrd a")},
+			{CidrIp: aws.String("198.51.100.2/32"), Description: aws.String("knockrd b")},
+		},
+		Ipv6Ranges: []*ec2.Ipv6Range{
+			{CidrIpv6: aws.String("2001:db8::1/128"), Description: aws.String("knockrd c")},
+		},
+	}
+	perms := knockrd.SplitIPPermission(perm)
+	expected := []string{"198.51.100.1/32 knockrd a", "198.51.100.2/32 knockrd b", "2001:db8::1/128 knockrd c"}
+	if len(perms) != len(expected) {
+		t.Fatalf("unexpected permissions %s", knockrd.JSONString(perms))
+	}
+	for i, p := range perms {
+		if len(p.IpRanges)+len(p.Ipv6Ranges) != 1 {
+			t.Errorf("must have a range %s", knockrd.JSONString(p))
+			continue
+		}
+		if aws.StringValue(p.IpProtocol) != "tcp" || aws.Int64Value(p.FromPort) != 443 || aws.Int64Value(p.ToPort) != 443 {
+			t.Errorf("unexpected protocol or ports %s", knockrd.JSONString(p))
+		}
+		var r string
+		if len(p.IpRanges) == 1 {
+			r = aws.StringValue(p.IpRanges[0].CidrIp) + " " + aws.StringValue(p.IpRanges[0].Description)
+		} else {
+			r = aws.StringValue(p.Ipv6Ranges[0].CidrIpv6) + " " + aws.StringValue(p.Ipv6Ranges[0].Description)
+		}
+		if r != expected[i] {
+			t.Errorf("unexpected range %s", r)
+		}
+	}
+	if perms := knockrd.SplitIPPermission(&ec2.IpPermission{IpProtocol: aws.String("-1")}); len(perms) != 0 {
+		t.Errorf("unexpected permissions %s", knockrd.JSONString(perms))
+	}
+}
+
+func TestSecurityGroupIngressErrors(t *testing.T) {
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		SecurityGroups: []*knockrd.SecurityGroupConfig{
+			{ID: "sg-1", FromPort: 22, ToPort: 22, Protocol: "tcp"},
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		rules    []string
+		raced    func(f *fakeEC2)
+		errs     map[string]error
+		records  []string
+		expected []string
+		err      bool
+	}{
+		{
+			name:    "duplicated by others",
+			raced:   func(f *fakeEC2) { f.addRule("sg-1", "198.51.100.2/32", "knockrd at:2020-05-01T00:00:00Z") },
+			records: []string{"INSERT 198.51.100.1", "INSERT 198.51.100.2", "INSERT 198.51.100.3"},
+			expected: []string{
+				"authorize sg-1 198.51.100.1/32,198.51.100.2/32,198.51.100.3/32",
+				"authorize sg-1 198.51.100.1/32",
+				"authorize sg-1 198.51.100.2/32",
+				"authorize sg-1 198.51.100.3/32",
+			},
+		},
+		{
+			name:  "revoked by others",
+			rules: []string{"198.51.100.1/32", "198.51.100.2/32"},
+			raced: func(f *fakeEC2) {
+				f.groups["sg-1"].IpPermissions[0].IpRanges = f.groups["sg-1"].IpPermissions[0].IpRanges[1:]
+			},
+			records: []string{"REMOVE 198.51.100.1", "REMOVE 198.51.100.2"},
+			expected: []string{
+				"revoke sg-1 198.51.100.1/32,198.51.100.2/32",
+				"revoke sg-1 198.51.100.1/32",
+				"revoke sg-1 198.51.100.2/32",
+			},
+		},
+		{
+			name:     "authorize error",
+			errs:     map[string]error{"198.51.100.1/32": awserr.New("RulesPerSecurityGroupLimitExceeded", "limit exceeded", nil)},
+			records:  []string{"INSERT 198.51.100.1"},
+			expected: []string{"authorize sg-1 198.51.100.1/32"},
+			err:      true,
+		},
+		{
+			name:     "revoke error",
+			rules:    []string{"198.51.100.1/32"},
+			errs:     map[string]error{"198.51.100.1/32": awserr.New("UnauthorizedOperation", "not authorized", nil)},
+			records:  []string{"REMOVE 198.51.100.1"},
+			expected: []string{"revoke sg-1 198.51.100.1/32"},
+			err:      true,
+		},
+	} {
+		client := newFakeEC2()
+		client.groups["sg-1"] = &ec2.SecurityGroup{GroupId: aws.String("sg-1")}
+		for _, cidr := range tc.rules {
+			client.addRule("sg-1", cidr, "knockrd at:2020-05-01T00:00:00Z")
+		}
+		if tc.raced != nil {
+			raced := tc.raced
+			client.afterDescribe = func() {
+				raced(client)
+				client.afterDescribe = nil
+			}
+		}
+		for cidr, err := range tc.errs {
+			client.errs[cidr] = err
+		}
+		b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+		handler := knockrd.NewStreamHandlerWithEC2(conf, b, client)
+		ev := insertEvent()
+		for i, r := range tc.records {
+			p := strings.SplitN(r, " ", 2)
+			ev.Records = append(ev.Records, insertEvent(p[1]).Records[0])
+			ev.Records[i].EventName = p[0]
+			ev.Records[i].Change.SequenceNumber = fmt.Sprint(i + 1)
+		}
+		err := handler(context.Background(), ev)
+		if tc.err && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		} else if !tc.err && err != nil {
+			t.Errorf("%s: unexpected error %s", tc.name, err)
+		}
+		// the first attempt of the batch
+		calls := client.calls
+		if len(calls) > len(tc.expected) {
+			calls = calls[:len(tc.expected)]
+		}
+		if strings.Join(calls, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("%s: unexpected calls %#v", tc.name, client.calls)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package knockrd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// serviceKeySeparator separates a service name and an address in keys of the backend.
+const serviceKeySeparator = "#"
+
+var serviceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ServiceConfig represents a service which has its own targets and TTL.
+// Allowances for a service are stored with keys namespaced by the service name, and applied only to targets of the service.
+type ServiceConfig struct {
+	Name        string        `yaml:"name"`
+	Description string        `yaml:"description"`
+	TTL         time.Duration `yaml:"ttl"` // default ttl
+
+	IPSets          IPSetsConfig            `yaml:"ip_sets"`
+	Consul          *ConsulConfig           `yaml:"consul"`
+	SecurityGroups  []*SecurityGroupConfig  `yaml:"security_groups"`
+	PrefixLists     PrefixListsConfig       `yaml:"prefix_lists"`
+	NetworkACLs     []*NetworkACLConfig     `yaml:"network_acls"`
+	Firewall        *FirewallConfig         `yaml:"firewall"`
+	AllowFiles      []*AllowFileConfig      `yaml:"allow_files"`
+	HAProxy         []*HAProxyConfig        `yaml:"haproxy"`
+	Kubernetes      *KubernetesConfig       `yaml:"kubernetes"`
+	CloudflareLists []*CloudflareListConfig `yaml:"cloudflare_lists"`
+	Webhooks        []*WebhookConfig        `yaml:"webhooks"`
+	Etcd            *EtcdConfig             `yaml:"etcd"`
+}
+
+func (c *ServiceConfig) String() string {
+	return "service:" + c.Name
+}
+
+// serviceConfig returns a config which has targets and TTL of the service instead of the top level ones.
+func (c *Config) serviceConfig(svc *ServiceConfig) *Config {
+	sc := *c
+	sc.TTL = svc.TTL
+	sc.IPSet = nil
+	sc.IPSets = svc.IPSets
+	sc.Consul = svc.Consul
+	sc.SecurityGroups = svc.SecurityGroups
+	sc.PrefixLists = svc.PrefixLists
+	sc.NetworkACLs = svc.NetworkACLs
+	sc.Firewall = svc.Firewall
+	sc.AllowFiles = svc.AllowFiles
+	sc.HAProxy = svc.HAProxy
+	sc.Kubernetes = svc.Kubernetes
+	sc.CloudflareLists = svc.CloudflareLists
+	sc.Webhooks = svc.Webhooks
+	sc.Etcd = svc.Etcd
+	sc.Services = nil
+	return &sc
+}
+
+// validateServices validates services and their targets.
+func (c *Config) validateServices() error {
+	names := make(map[string]bool, len(c.Services))
+	for _, svc := range c.Services {
+		if !serviceNameRegexp.MatchString(svc.Name) {
+			return fmt.Errorf("invalid services.name %q", svc.Name)
+		}
+		if names[svc.Name] {
+			return fmt.Errorf("duplicated services.name %s", svc.Name)
+		}
+		names[svc.Name] = true
+		if svc.TTL == 0 {
+			svc.TTL = c.TTL
+		}
+		if svc.TTL < 0 {
+			return fmt.Errorf("invalid ttl %s for %s", svc.TTL, svc)
+		}
+		if err := c.serviceConfig(svc).validateTargets(); err != nil {
+			return fmt.Errorf("%s: %s", svc, err)
+		}
+	}
+	return nil
+}
+
+// findService returns the service of the name, or nil.
+func findService(services []*ServiceConfig, name string) *ServiceConfig {
+	for _, svc := range services {
+		if svc.Name == name {
+			return svc
+		}
+	}
+	return nil
+}
+
+// serviceKey returns the key in the backend of the allowance for the service.
+func serviceKey(service, key string) string {
+	if service == "" {
+		return key
+	}
+	return service + serviceKeySeparator + key
+}
+
+// splitServiceKey splits the key in the backend into a service and an address.
+func splitServiceKey(key string) (string, string) {
+	if i := strings.Index(key, serviceKeySeparator); i >= 0 {
+		return key[:i], key[i+len(serviceKeySeparator):]
+	}
+	return "", key
+}
+
+// eventsOfService returns events of the service.
+func eventsOfService(evs []ipSetEvent, service string) []ipSetEvent {
+	res := make([]ipSetEvent, 0, len(evs))
+	for _, ev := range evs {
+		if ev.service == service {
+			res = append(res, ev)
+		}
+	}
+	return res
+}
+
+// scopedSinks wraps sinks to apply only events of the service.
+// Sinks are skipped when the batch has events only for other services.
+func scopedSinks(service string, sinks []sink) []sink {
+	res := make([]sink, 0, len(sinks))
+	for _, sk := range sinks {
+		sk := sk
+		name := sk.name
+		if service != "" {
+			name = "service:" + service + " " + name
+		}
+		res = append(res, sink{name: name, batch: sk.batch, update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			sv4, sv6 := eventsOfService(v4, service), eventsOfService(v6, service)
+			if len(sv4)+len(sv6) == 0 && len(v4)+len(v6) > 0 {
+				return nil
+			}
+			return sk.update(ctx, sv4, sv6)
+		}})
+	}
+	return res
+}
+
+// serviceStreamers returns streamers for targets of services.
+// They share the executor and the backend with the streamer.
+func (s *streamer) serviceStreamers() []*streamer {
+	s.servicesOnce.Do(func() {
+		for _, svc := range s.conf.Services {
+			ss := newStreamer(s.conf.serviceConfig(svc))
+			ss.service = svc.Name
+			ss.executor = s.executor
+			ss.parent = s
+			s.services = append(s.services, ss)
+		}
+	})
+	return s.services
+}
@@ -0,0 +1,155 @@
+package knockrd_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+func TestServiceAllowance(t *testing.T) {
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	conf := &knockrd.Config{
+		Services: []*knockrd.ServiceConfig{
+			{Name: "grafana", Description: "dashboards", TTL: 30 * time.Minute},
+			{Name: "ssh-prod", TTL: 4 * time.Hour},
+		},
+	}
+	allow, auth := knockrd.NewHTTPHandlers(b, conf, "foo@example.com")
+
+	body, token := getAllow(t, allow, "198.51.100.1")
+	for _, s := range []string{`name="service" value="grafana"> grafana - dashboards`, `name="service" value="ssh-prod"> ssh-prod`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%s is not found in %s", s, body)
+		}
+	}
+	w := postAllow(allow, "198.51.100.1", url.Values{"csrf_token": {token}, "allow": {"allow"}, "service": {"grafana"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "is allowed for 30m to grafana.") {
+		t.Errorf("unexpected body %s", w.Body.String())
+	}
+	items, _ := b.List()
+	if len(items) != 1 || items[0].Key != "grafana#198.51.100.1" {
+		t.Errorf("unexpected items %#v", items)
+	}
+
+	_, token = getAllow(t, allow, "198.51.100.1")
+	if w := postAllow(allow, "198.51.100.1", url.Values{"csrf_token": {token}, "allow": {"allow"}, "service": {"unknown"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d for unknown service", w.Code)
+	}
+
+	for path, code := range map[string]int{
+		"/auth?service=grafana":  http.StatusOK,
+		"/auth?service=ssh-prod": http.StatusForbidden,
+		"/auth":                  http.StatusForbidden,
+		"/auth?service=unknown":  http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Real-IP", "198.51.100.1")
+		w := httptest.NewRecorder()
+		auth(w, req)
+		if w.Code != code {
+			t.Errorf("unexpected status %d for %s", w.Code, path)
+		}
+	}
+
+	_, token = getAllow(t, allow, "198.51.100.1")
+	if w := postAllow(allow, "198.51.100.1", url.Values{"csrf_token": {token}, "disallow": {"disallow"}, "service": {"grafana", "ssh-prod"}}); w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+	if items, _ := b.List(); len(items) != 0 {
+		t.Errorf("unexpected items %#v", items)
+	}
+}
+
+func TestServiceStream(t *testing.T) {
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Firewall: &knockrd.FirewallConfig{
+			Type:  knockrd.FirewallTypeIPSet,
+			SetV4: "knockrd",
+		},
+		Services: []*knockrd.ServiceConfig{
+			{
+				Name: "ssh-prod",
+				TTL:  4 * time.Hour,
+				Firewall: &knockrd.FirewallConfig{
+					Type:  knockrd.FirewallTypeIPSet,
+					SetV4: "ssh",
+				},
+			},
+			{
+				Name: "grafana",
+				TTL:  time.Hour,
+				Firewall: &knockrd.FirewallConfig{
+					Type:  knockrd.FirewallTypeIPSet,
+					SetV4: "grafana",
+				},
+			},
+		},
+	}
+	var commands []string
+	handler := knockrd.NewStreamHandlerWithExecutor(conf, func(_ context.Context, stdin string, name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	})
+	var ev events.DynamoDBEvent
+	for _, key := range []string{"198.51.100.1", "ssh-prod#198.51.100.2", "unknown#198.51.100.3"} {
+		ev.Records = append(ev.Records, events.DynamoDBEventRecord{
+			EventName: "INSERT",
+			Change: events.DynamoDBStreamRecord{
+				Keys: map[string]events.DynamoDBAttributeValue{"Key": events.NewStringAttribute(key)},
+			},
+		})
+	}
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ipset add knockrd 198.51.100.1/32 timeout 3600 -exist",
+		"ipset add ssh 198.51.100.2/32 timeout 14400 -exist",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands %#v", commands)
+	}
+}
+
+func TestLoadConfigServices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for yaml, valid := range map[string]bool{
+		"services:\n  - name: grafana\n    ttl: 30m\n  - name: ssh-prod\n":                        true,
+		"services:\n  - name: 'foo#bar'\n":                                                        false,
+		"services:\n  - name: ''\n":                                                               false,
+		"services:\n  - name: grafana\n  - name: grafana\n":                                       false,
+		"services:\n  - name: ssh-prod\n    firewall:\n      type: iptables\n      set_v4: ssh\n": false,
+	} {
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := knockrd.LoadConfig(path)
+		if valid && err != nil {
+			t.Errorf("unexpected error %s for %s", err, yaml)
+		} else if !valid && err == nil {
+			t.Errorf("expected an error for %s", yaml)
+		}
+		if valid && (c.Services[0].TTL != 30*time.Minute || c.Services[1].TTL != knockrd.DefaultTTL) {
+			t.Errorf("unexpected ttl of services %s %s", c.Services[0].TTL, c.Services[1].TTL)
+		}
+	}
+}
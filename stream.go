@@ -5,185 +5,597 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"net/url"
-	"os"
-	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
 	mapset "github.com/deckarep/golang-set"
 	consul "github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
+	"github.com/shogo82148/go-retry"
 )
 
-var DefaultConsulKVPath = "knockrd/allowed"
-
 type streamer struct {
-	conf          *Config
-	wafv2Regional *wafv2.WAFV2
-	wafv2CF       *wafv2.WAFV2
-	ec2           *ec2.EC2
+	conf     *Config
+	ec2      ec2iface.EC2API
+	wafv2    map[string]wafv2iface.WAFV2API // by region
+	executor commandExecutor
+	backend  Backend
+
+	allowFiles    []*allowFileWriter
+	haproxySynced bool
+	kubernetes    *kubernetesClient
+	consul        *consul.Client
+	etcd          *etcdClient
+	mu            sync.Mutex
+
+	service      string    // name of the service for a streamer of the service
+	parent       *streamer // streamer which has the backend
+	services     []*streamer
+	servicesOnce sync.Once
 }
 
 // NewStreamHandler creates a DynamoDB Stream handler function
 func NewStreamHandler(conf *Config) func(context.Context, events.DynamoDBEvent) error {
-	awsCfgRegional := &aws.Config{
-		Region: aws.String(conf.AWS.Region),
-	}
-	awsCfgCF := &aws.Config{
-		Region: aws.String("us-east-1"), // for CloudFront
-	}
-	if conf.AWS.Endpoint != "" {
-		awsCfgRegional.Endpoint = aws.String(conf.AWS.Endpoint)
-		awsCfgCF.Endpoint = aws.String(conf.AWS.Endpoint)
-	}
+	return newStreamer(conf).Handler
+}
 
-	s := &streamer{
-		conf:          conf,
-		wafv2Regional: wafv2.New(session.New(), awsCfgRegional),
-		wafv2CF:       wafv2.New(session.New(), awsCfgCF),
-		ec2:           ec2.New(session.New(), awsCfgRegional),
+func newStreamer(conf *Config) *streamer {
+	return &streamer{
+		conf:     conf,
+		ec2:      ec2.New(session.New(), conf.awsConfig(conf.AWS.Region)),
+		wafv2:    make(map[string]wafv2iface.WAFV2API),
+		executor: execCommandExecutor{},
 	}
-
-	return s.Handler
 }
 
 type ipSetEvent struct {
-	address string
-	add     bool
-	v4      bool
+	address  string // an IP address, or a network in CIDR notation for a widened allowance
+	service  string
+	add      bool
+	v4       bool
+	identity string
+	expires  time.Time
 }
 
 func (e ipSetEvent) CIDR() string {
+	if strings.Contains(e.address, "/") {
+		return e.address
+	}
 	if e.v4 {
 		return e.address + "/32"
 	}
 	return e.address + "/128"
 }
 
+// key returns the key in the backend.
+func (e ipSetEvent) key() string {
+	return serviceKey(e.service, e.address)
+}
+
+func newIPSetEvent(key string, add bool) *ipSetEvent {
+	service, address := splitServiceKey(key)
+	var ev *ipSetEvent
+	if strings.Contains(address, "/") {
+		ev = newNetworkIPSetEvent(address, add)
+	} else {
+		ev = newAddressIPSetEvent(address, add)
+	}
+	if ev != nil {
+		ev.service = service
+	}
+	return ev
+}
+
+func newAddressIPSetEvent(key string, add bool) *ipSetEvent {
+	ip := net.ParseIP(key)
+	if ip == nil {
+		return nil
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		log.Printf("[debug] IPV4 %s add %t", ip.String(), add)
+		return &ipSetEvent{address: ipv4.String(), add: add, v4: true}
+	}
+	log.Printf("[debug] IPV6 %s add %t", ip.String(), add)
+	return &ipSetEvent{address: ip.String(), add: add, v4: false}
+}
+
+// newNetworkIPSetEvent returns an event for a widened allowance keyed by a network.
+func newNetworkIPSetEvent(key string, add bool) *ipSetEvent {
+	ip, ipnet, err := net.ParseCIDR(key)
+	if err != nil || !ip.Equal(ipnet.IP) {
+		return nil
+	}
+	v4 := ip.To4() != nil
+	log.Printf("[debug] network %s add %t", ipnet.String(), add)
+	return &ipSetEvent{address: ipnet.String(), add: add, v4: v4}
+}
+
+// setAttributes sets attributes of the event from the item image on the stream.
+// The image is available when StreamViewType of the stream is NEW_AND_OLD_IMAGES.
+func (e *ipSetEvent) setAttributes(image map[string]events.DynamoDBAttributeValue) {
+	if v, ok := image["Identity"]; ok && v.DataType() == events.DataTypeString {
+		e.identity = v.String()
+	}
+	if v, ok := image["Expires"]; ok && v.DataType() == events.DataTypeNumber {
+		if ts, err := v.Integer(); err == nil {
+			e.expires = time.Unix(ts, 0)
+		}
+	}
+}
+
+func (s *streamer) getBackend() (Backend, error) {
+	if s.parent != nil {
+		return s.parent.getBackend()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backend != nil {
+		return s.backend, nil
+	}
+	b, err := NewDynamoDBBackend(s.conf)
+	if err != nil {
+		return nil, err
+	}
+	s.backend = b
+	return b, nil
+}
+
+// activeEvents returns events which add active allowances for the service of the streamer in the backend.
+func (s *streamer) activeEvents() ([]ipSetEvent, error) {
+	b, err := s.getBackend()
+	if err != nil {
+		return nil, err
+	}
+	items, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	evs := make([]ipSetEvent, 0, len(items))
+	for _, item := range items {
+		ev := newIPSetEvent(item.Key, true)
+		if ev == nil || ev.service != s.service {
+			continue
+		}
+		ev.identity = item.Identity
+		if item.Expires > 0 {
+			ev.expires = time.Unix(item.Expires, 0)
+		}
+		evs = append(evs, *ev)
+	}
+	return evs, nil
+}
+
+// activeCIDRs returns CIDRs of active allowances in the backend.
+func (s *streamer) activeCIDRs() (mapset.Set, error) {
+	evs, err := s.activeEvents()
+	if err != nil {
+		return nil, err
+	}
+	cidrs := mapset.NewSet()
+	for _, ev := range evs {
+		cidrs.Add(ev.CIDR())
+	}
+	return cidrs, nil
+}
+
+// latestEvents returns the last event for each address in order of appearance.
+func latestEvents(events ...[]ipSetEvent) []ipSetEvent {
+	var cidrs []string
+	latest := make(map[string]ipSetEvent)
+	for _, evs := range events {
+		for _, ev := range evs {
+			if _, ok := latest[ev.CIDR()]; !ok {
+				cidrs = append(cidrs, ev.CIDR())
+			}
+			latest[ev.CIDR()] = ev
+		}
+	}
+	res := make([]ipSetEvent, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		res = append(res, latest[cidr])
+	}
+	return res
+}
+
 func parseEventRecord(r events.DynamoDBEventRecord) *ipSetEvent {
 	key, ok := r.Change.Keys["Key"]
 	if !ok {
 		log.Printf("[warn] unkown key %v", r.Change.Keys)
 		return nil
 	}
-	ip := net.ParseIP(key.String())
-	if ip == nil {
+	var add bool
+	switch r.EventName {
+	case "INSERT", "MODIFY":
+		add = true
+	case "REMOVE":
+	default:
+		log.Printf("[warn] unknown event %s", r.EventName)
+		return nil
+	}
+	ev := newIPSetEvent(key.String(), add)
+	if ev == nil {
 		log.Printf("[debug] ignore Key:%s", key.String())
 		return nil
 	}
-	log.Printf("[info] processing IP:%s Event:%s", ip.String(), r.EventName)
-	var add bool
-	if ipv4 := ip.To4(); ipv4 != nil {
-		switch r.EventName {
-		case "INSERT", "MODIFY":
-			add = true
-		case "REMOVE":
-		default:
-			log.Printf("[warn] unknown event %s", r.EventName)
-			return nil
-		}
-		log.Printf("[debug] IPV4 %s add %t", ip.String(), add)
-		return &ipSetEvent{ipv4.String(), add, true}
+	if add {
+		ev.setAttributes(r.Change.NewImage)
 	} else {
-		switch r.EventName {
-		case "INSERT", "MODIFY":
-			add = true
-		case "REMOVE":
-		default:
-			log.Printf("[warn] unknown event %s", r.EventName)
-			return nil
-		}
-		log.Printf("[debug] IPV6 %s add %t", ip.String(), add)
-		return &ipSetEvent{ip.String(), add, false}
+		ev.setAttributes(r.Change.OldImage)
 	}
+	log.Printf("[info] processing IP:%s Event:%s Identity:%s", ev.key(), r.EventName, ev.identity)
+	return ev
 }
 
+// Handler applies records of the DynamoDB stream to targets.
+// When some targets fail, the failed targets are applied again record by record to find the first failed record,
+// and a *batchItemFailureError for the record is returned.
+// Batch targets (e.g. Kubernetes) are not applied again. When one of them fails, the first record is reported.
+// Webhooks sent before a failure are not sent again in the invocation.
 func (s *streamer) Handler(ctx context.Context, event events.DynamoDBEvent) error {
+	ctx = withSentWebhooks(ctx)
 	var v4, v6 []ipSetEvent
-	for _, r := range event.Records {
+	evs := make([]*ipSetEvent, len(event.Records))
+	for i, r := range event.Records {
 		ipsev := parseEventRecord(r)
 		if ipsev == nil {
 			continue
 		}
+		evs[i] = ipsev
 		if ipsev.v4 {
 			v4 = append(v4, *ipsev)
 		} else {
 			v6 = append(v6, *ipsev)
 		}
 	}
-	if s.conf.IPSet != nil {
-		if err := s.updateIPSet(s.conf.IPSet.V4, v4); err != nil {
-			return err
+	failed, err := s.applySinks(ctx, s.sinks(), v4, v6)
+	if err == nil {
+		return nil
+	}
+	for _, sk := range failed {
+		if sk.batch {
+			for i, ev := range evs {
+				if ev != nil {
+					return &batchItemFailureError{
+						sequenceNumber: event.Records[i].Change.SequenceNumber,
+						err:            err,
+					}
+				}
+			}
 		}
-		if err := s.updateIPSet(s.conf.IPSet.V6, v6); err != nil {
-			return err
+	}
+	for i, ev := range evs {
+		if ev == nil {
+			continue
+		}
+		var err error
+		if ev.v4 {
+			_, err = s.applySinks(ctx, failed, []ipSetEvent{*ev}, nil)
+		} else {
+			_, err = s.applySinks(ctx, failed, nil, []ipSetEvent{*ev})
+		}
+		if err != nil {
+			return &batchItemFailureError{
+				sequenceNumber: event.Records[i].Change.SequenceNumber,
+				err:            err,
+			}
 		}
 	}
-	if s.conf.Consul != nil {
-		if err := s.updateConsulKV(s.conf.Consul, v4, v6); err != nil {
-			return err
+	return nil
+}
+
+// handleEvents applies events published in the process.
+// Failed targets are applied again by retryPolicy, and targets succeeded are not applied again.
+func (s *streamer) handleEvents(ctx context.Context, evs []ipSetEvent) error {
+	ctx = withSentWebhooks(ctx)
+	var v4, v6 []ipSetEvent
+	for _, ev := range evs {
+		if ev.v4 {
+			v4 = append(v4, ev)
+		} else {
+			v6 = append(v6, ev)
 		}
 	}
+	sinks := s.sinks()
+	return retryPolicy.Do(ctx, func() error {
+		failed, err := s.applySinks(ctx, sinks, v4, v6)
+		sinks = failed
+		return err
+	})
+}
+
+// skipByDryRun logs the operation and returns true in dry-run mode.
+func (s *streamer) skipByDryRun(format string, args ...interface{}) bool {
+	if !s.conf.DryRun {
+		return false
+	}
+	log.Printf("[info] (dry-run) "+format, args...)
+	return true
+}
+
+// sink is a target to apply events.
+type sink struct {
+	name   string
+	update func(ctx context.Context, v4, v6 []ipSetEvent) error
+	// batch sinks apply whole state recomputed from the backend, so they are not replayed record by record.
+	batch bool
+}
+
+// sinks returns sinks for all of configured targets and targets of services in order.
+// Each sink applies only events of its service.
+func (s *streamer) sinks() []sink {
+	sinks := scopedSinks(s.service, s.targetSinks())
+	for _, ss := range s.serviceStreamers() {
+		sinks = append(sinks, scopedSinks(ss.service, ss.targetSinks())...)
+	}
+	return sinks
+}
+
+// targetSinks returns sinks for configured targets of the streamer in order.
+func (s *streamer) targetSinks() []sink {
+	var sinks []sink
+	for _, c := range s.conf.IPSets.V4 {
+		c := c
+		sinks = append(sinks, sink{name: c.String(), update: func(ctx context.Context, v4, _ []ipSetEvent) error {
+			return s.updateIPSet(ctx, c, v4)
+		}})
+	}
+	for _, c := range s.conf.IPSets.V6 {
+		c := c
+		sinks = append(sinks, sink{name: c.String(), update: func(ctx context.Context, _, v6 []ipSetEvent) error {
+			return s.updateIPSet(ctx, c, v6)
+		}})
+	}
+	for _, c := range s.conf.PrefixLists.V4 {
+		c := c
+		sinks = append(sinks, sink{name: c.String(), update: func(ctx context.Context, v4, _ []ipSetEvent) error {
+			return s.updatePrefixList(ctx, c, v4)
+		}})
+	}
+	for _, c := range s.conf.PrefixLists.V6 {
+		c := c
+		sinks = append(sinks, sink{name: c.String(), update: func(ctx context.Context, _, v6 []ipSetEvent) error {
+			return s.updatePrefixList(ctx, c, v6)
+		}})
+	}
+	if s.conf.Consul != nil {
+		sinks = append(sinks, sink{name: "consul", update: func(_ context.Context, v4, v6 []ipSetEvent) error {
+			return s.updateConsulKV(s.conf.Consul, v4, v6)
+		}})
+	}
+	if s.conf.Etcd != nil {
+		sinks = append(sinks, sink{name: "etcd", update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			return s.updateEtcd(ctx, s.conf.Etcd, v4, v6)
+		}})
+	}
 	if len(s.conf.SecurityGroups) > 0 {
-		if err := s.updateSecurityGroup(s.conf.SecurityGroups, v4, v6); err != nil {
-			return err
+		sinks = append(sinks, sink{name: "security-groups", update: func(_ context.Context, v4, v6 []ipSetEvent) error {
+			return s.updateSecurityGroup(s.conf.SecurityGroups, v4, v6)
+		}})
+	}
+	for _, c := range s.conf.NetworkACLs {
+		c := c
+		sinks = append(sinks, sink{name: c.String(), update: func(_ context.Context, v4, v6 []ipSetEvent) error {
+			return s.updateNetworkACL(c, v4, v6)
+		}})
+	}
+	if s.conf.Firewall != nil {
+		sinks = append(sinks, sink{name: "firewall", update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			return s.updateFirewall(ctx, s.conf.Firewall, v4, v6)
+		}})
+	}
+	for _, c := range s.conf.HAProxy {
+		c := c
+		sinks = append(sinks, sink{name: c.String(), update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			if err := s.syncHAProxy(ctx); err != nil {
+				return err
+			}
+			return s.updateHAProxy(ctx, c, v4, v6)
+		}})
+	}
+	if s.conf.Kubernetes != nil {
+		sinks = append(sinks, sink{name: "kubernetes", batch: true, update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			if len(v4)+len(v6) == 0 {
+				return nil
+			}
+			return s.updateKubernetes(ctx)
+		}})
+	}
+	if len(s.conf.CloudflareLists) > 0 {
+		sinks = append(sinks, sink{name: "cloudflare-lists", batch: true, update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			if len(v4)+len(v6) == 0 {
+				return nil
+			}
+			return s.updateCloudflare(ctx)
+		}})
+	}
+	for _, c := range s.conf.Webhooks {
+		c := c
+		sinks = append(sinks, sink{name: c.String(), update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			return s.sendWebhook(ctx, c, v4, v6)
+		}})
+	}
+	if len(s.conf.AllowFiles) > 0 {
+		sinks = append(sinks, sink{name: "allow-files", batch: true, update: func(ctx context.Context, v4, v6 []ipSetEvent) error {
+			if len(v4)+len(v6) == 0 {
+				return nil
+			}
+			return s.updateAllowFiles(ctx)
+		}})
+	}
+	return sinks
+}
+
+// applySinks applies events to each sink, and returns failed sinks.
+// A failure of a sink doesn't block other sinks.
+func (s *streamer) applySinks(ctx context.Context, sinks []sink, v4, v6 []ipSetEvent) ([]sink, error) {
+	var failed []sink
+	var msgs []string
+	for _, sk := range sinks {
+		if err := sk.update(ctx, v4, v6); err != nil {
+			log.Printf("[error] failed to apply %d events to %s: %s", len(v4)+len(v6), sk.name, err)
+			putMetric("SinkFailures", 1, "Count", map[string]string{"Sink": sk.name})
+			failed = append(failed, sk)
+			msgs = append(msgs, fmt.Sprintf("%s: %s", sk.name, err))
 		}
 	}
-	return nil
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to apply events to %s", strings.Join(msgs, ", "))
+	}
+	return nil, nil
 }
 
-func (s *streamer) updateIPSet(c *IPSetConfig, events []ipSetEvent) error {
+// updateIPSet applies events to the IP set and its spillover IP sets.
+// Added addresses are put into the first IP set which has room.
+func (s *streamer) updateIPSet(ctx context.Context, c *IPSetConfig, events []ipSetEvent) error {
 	if c == nil || c.ID == "" || len(events) == 0 {
 		return nil
 	}
-	var svc *wafv2.WAFV2
+	var add, remove []string
+	for _, ev := range latestEvents(events, nil) {
+		if ev.add {
+			add = append(add, ev.CIDR())
+		} else {
+			remove = append(remove, ev.CIDR())
+		}
+	}
+	chain := c.chain()
+	buckets := make([]*capacityBucket, 0, len(chain))
+	for _, ic := range chain {
+		_, addrs, _, err := s.getIPSet(ic)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get %s", ic)
+		}
+		log.Printf("[debug] current addresses of %s %s", ic, addrs.String())
+		buckets = append(buckets, newCapacityBucket(ic.String(), ic.maxEntries(), 1, addrs.Cardinality(), addrs, addrs.Clone()))
+	}
+	unplaced, err := s.newCapacityPlanner(buckets, true).place(add, remove)
+	if err != nil {
+		return err
+	}
+	for i, b := range buckets {
+		if !b.changed() {
+			continue
+		}
+		err := s.modifyIPSet(ctx, chain[i], func(addrs mapset.Set) bool {
+			for _, cidr := range b.remove {
+				log.Printf("[debug] remove address %s", cidr)
+				addrs.Remove(cidr)
+			}
+			for _, cidr := range b.add {
+				log.Printf("[debug] add address %s", cidr)
+				addrs.Add(cidr)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	reportUnplaced(buckets, unplaced)
+	return nil
+}
+
+// chain returns the IP set and its spillover IP sets.
+func (c *IPSetConfig) chain() []*IPSetConfig {
+	return append([]*IPSetConfig{c}, c.Spillover...)
+}
+
+func (c *IPSetConfig) maxEntries() int {
+	if c.MaxEntries > 0 {
+		return c.MaxEntries
+	}
+	return DefaultIPSetMaxEntries
+}
+
+// modifyIPSet runs a read-modify-write cycle for the IP set.
+// modify updates addrs in place and returns whether the IP set should be updated.
+// The cycle is retried by retryPolicy when the update conflicts with other updates.
+func (s *streamer) modifyIPSet(ctx context.Context, c *IPSetConfig, modify func(addrs mapset.Set) bool) error {
+	var attempts int
+	defer func() {
+		if attempts > 1 {
+			putMetric("IPSetUpdateRetries", float64(attempts-1), "Count", map[string]string{"IPSet": c.Name, "Region": c.Region})
+		}
+	}()
+	return retryPolicy.Do(ctx, func() error {
+		attempts++
+		svc, addrs, lockToken, err := s.getIPSet(c)
+		if err != nil {
+			return retry.MarkPermanent(err)
+		}
+		if !modify(addrs) {
+			return nil
+		}
+		err = s.putIPSet(svc, c, addrs, lockToken)
+		if isOptimisticLockError(err) {
+			log.Printf("[warn] update %s conflicted (attempt %d), retrying", c, attempts)
+			return err
+		} else if err != nil {
+			return retry.MarkPermanent(err)
+		}
+		return nil
+	})
+}
+
+func isOptimisticLockError(err error) bool {
+	return isAWSErrorCode(err, wafv2.ErrCodeWAFOptimisticLockException)
+}
+
+func (s *streamer) wafv2Client(c *IPSetConfig) (wafv2iface.WAFV2API, error) {
 	switch c.Scope {
-	case "REGIONAL":
-		svc = s.wafv2Regional
-	case "CLOUDFRONT":
-		svc = s.wafv2CF
+	case "REGIONAL", "CLOUDFRONT":
 	default:
-		return fmt.Errorf("invalid scope %s: Set REGIONAL or CLOUDFRONT", c.Scope)
+		return nil, fmt.Errorf("invalid scope %s: Set REGIONAL or CLOUDFRONT", c.Scope)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if svc, ok := s.wafv2[c.Region]; ok {
+		return svc, nil
 	}
+	svc := wafv2.New(session.New(), s.conf.awsConfig(c.Region))
+	s.wafv2[c.Region] = svc
+	return svc, nil
+}
 
+func (s *streamer) getIPSet(c *IPSetConfig) (wafv2iface.WAFV2API, mapset.Set, *string, error) {
+	svc, err := s.wafv2Client(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	res, err := svc.GetIPSet(&wafv2.GetIPSetInput{
 		Name:  &c.Name,
 		Id:    &c.ID,
 		Scope: &c.Scope,
 	})
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
-	lockToken := res.LockToken
 	addrs := mapset.NewSet()
 	for _, ad := range res.IPSet.Addresses {
 		_, ipnet, _ := net.ParseCIDR(*ad)
 		addrs.Add(ipnet.String())
 	}
-	log.Printf("[debug] current addresses %s", addrs.String())
-	for _, e := range events {
-		if e.add {
-			log.Printf("[debug] add address %s", e.CIDR())
-			addrs.Add(e.CIDR())
-		} else {
-			log.Printf("[debug] remove address %s", e.CIDR())
-			addrs.Remove(e.CIDR())
-		}
+	return svc, addrs, res.LockToken, nil
+}
+
+func (s *streamer) putIPSet(svc wafv2iface.WAFV2API, c *IPSetConfig, addrs mapset.Set, lockToken *string) error {
+	if s.skipByDryRun("update %s addresses:%s", c, addrs.String()) {
+		return nil
 	}
-	log.Printf(
-		"[info] update ip-set id:%s name:%s scope:%s addresses:%s",
-		c.ID, c.Name, c.Scope, addrs.String(),
-	)
+	log.Printf("[info] update %s addresses:%s", c, addrs.String())
 	updates := make([]*string, 0, addrs.Cardinality())
 	for _, ad := range addrs.ToSlice() {
 		updates = append(updates, aws.String(ad.(string)))
 	}
-	_, err = svc.UpdateIPSet(&wafv2.UpdateIPSetInput{
+	_, err := svc.UpdateIPSet(&wafv2.UpdateIPSetInput{
 		Name:      &c.Name,
 		Id:        &c.ID,
 		Scope:     &c.Scope,
@@ -192,111 +604,3 @@ func (s *streamer) updateIPSet(c *IPSetConfig, events []ipSetEvent) error {
 	})
 	return err
 }
-
-func (s *streamer) updateConsulKV(c *ConsulConfig, events ...[]ipSetEvent) error {
-	client, err := consul.NewClient(&consul.Config{
-		Address:    c.Address,
-		Scheme:     c.Scheme,
-		Datacenter: c.Datacenter,
-	})
-	if err != nil {
-		return errors.Wrap(err, "failed to new consul client")
-	}
-	kv := client.KV()
-	kvPath := c.KVPath
-	if kvPath == "" {
-		kvPath = DefaultConsulKVPath
-	}
-	for _, evs := range events {
-		for _, ev := range evs {
-			key := path.Join(kvPath, url.PathEscape(ev.address))
-			if ev.add {
-				log.Printf("[info] put to consul key=%s", key)
-				p := consul.KVPair{
-					Key:   key,
-					Value: []byte(ev.CIDR()),
-				}
-				if _, err := kv.Put(&p, nil); err != nil {
-					return errors.Wrapf(err, "failed to put to consul key=%s", key)
-				}
-			} else {
-				log.Printf("[info] delete from consul key=%s", key)
-				if _, err = kv.Delete(key, nil); err != nil {
-					return errors.Wrapf(err, "failed to delete from consul key=%s", key)
-				}
-			}
-		}
-	}
-	return nil
-}
-
-func (s *streamer) updateSecurityGroup(groups []*SecurityGroupConfig, v4Events []ipSetEvent, v6Events []ipSetEvent) error {
-	description := aws.String(
-		fmt.Sprintf(
-			"by lambda function %s at %s",
-			os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
-			time.Now().Format(time.RFC3339),
-		),
-	)
-	for _, gc := range groups {
-		authorize := &ec2.IpPermission{
-			FromPort:   aws.Int64(gc.FromPort),
-			ToPort:     aws.Int64(gc.ToPort),
-			IpProtocol: aws.String(gc.Protocol),
-		}
-		revoke := &ec2.IpPermission{
-			FromPort:   aws.Int64(gc.FromPort),
-			ToPort:     aws.Int64(gc.ToPort),
-			IpProtocol: aws.String(gc.Protocol),
-		}
-		for _, ev := range v4Events {
-			if ev.add {
-				authorize.IpRanges = append(authorize.IpRanges, &ec2.IpRange{
-					CidrIp:      aws.String(ev.CIDR()),
-					Description: description,
-				})
-			} else {
-				revoke.IpRanges = append(revoke.IpRanges, &ec2.IpRange{
-					CidrIp:      aws.String(ev.CIDR()),
-					Description: description,
-				})
-			}
-		}
-		for _, ev := range v6Events {
-			if ev.add {
-				authorize.Ipv6Ranges = append(authorize.Ipv6Ranges, &ec2.Ipv6Range{
-					CidrIpv6:    aws.String(ev.CIDR()),
-					Description: description,
-				})
-			} else {
-				revoke.Ipv6Ranges = append(revoke.Ipv6Ranges, &ec2.Ipv6Range{
-					CidrIpv6:    aws.String(ev.CIDR()),
-					Description: description,
-				})
-			}
-		}
-		if len(authorize.IpRanges) > 0 || len(authorize.Ipv6Ranges) > 0 {
-			log.Printf("[debug] authorizing security group(%s) %s", gc.ID, JSONString(authorize))
-			_, err := s.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
-				GroupId:       aws.String(gc.ID),
-				IpPermissions: []*ec2.IpPermission{authorize},
-			})
-			if err != nil {
-				errors.Wrapf(err, "failed to AuthorizeSecurityGroupIngress for %s", gc.ID)
-			}
-			log.Printf("[info] authorized security group(%s) %s", gc.ID, JSONString(authorize))
-		}
-		if len(revoke.IpRanges) > 0 || len(revoke.Ipv6Ranges) > 0 {
-			log.Printf("[debug] revoking security group(%s) %s", gc.ID, JSONString(revoke))
-			_, err := s.ec2.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
-				GroupId:       aws.String(gc.ID),
-				IpPermissions: []*ec2.IpPermission{revoke},
-			})
-			if err != nil {
-				errors.Wrapf(err, "failed to RevokeSecurityGroupIngress for %s", gc.ID)
-			}
-			log.Printf("[info] revoked security group(%s) %s", gc.ID, JSONString(revoke))
-		}
-	}
-	return nil
-}
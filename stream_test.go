@@ -1,11 +1,25 @@
 package knockrd_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/aws/aws-sdk-go/service/wafv2/wafv2iface"
 	"github.com/fujiwara/knockrd"
 )
 
@@ -101,3 +115,170 @@ func TestStream(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+var dynamoDBStreamRecordWithImageJSON = []byte(`
+{
+  "eventID": "5",
+  "eventName": "INSERT",
+  "eventVersion": "1.1",
+  "eventSource": "aws:dynamodb",
+  "awsRegion": "us-east-1",
+  "dynamodb": {
+    "Keys": {
+      "Key": {
+        "S": "198.51.100.1"
+      }
+    },
+    "NewImage": {
+      "Key": {
+        "S": "198.51.100.1"
+      },
+      "Expires": {
+        "N": "1588291200"
+      },
+      "Identity": {
+        "S": "foo+bar@example.com"
+      }
+    },
+    "SequenceNumber": "555",
+    "StreamViewType": "NEW_AND_OLD_IMAGES"
+  },
+  "eventSourceARN": "stream-ARN"
+}
+`)
+
+func TestSecurityGroupRuleDescription(t *testing.T) {
+	var r events.DynamoDBEventRecord
+	if err := json.Unmarshal(dynamoDBStreamRecordWithImageJSON, &r); err != nil {
+		t.Fatal(err)
+	}
+	expected := "knockrd identity:foo+bar@example.com expires:2020-05-01T00:00:00Z"
+	if d := knockrd.SecurityGroupRuleDescriptionForRecord(r); d != expected {
+		t.Errorf("unexpected description %s", d)
+	}
+}
+
+func TestRunStreamEventDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	eventFile := filepath.Join(dir, "event.json")
+	if err := ioutil.WriteFile(eventFile, dynamoDBStreamEventJSON, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &knockrd.Config{
+		TTL:    time.Hour,
+		DryRun: true,
+		// commands are not executed in dry-run mode
+		Firewall: &knockrd.FirewallConfig{
+			Type:  knockrd.FirewallTypeIPSet,
+			SetV4: "knockrd",
+			SetV6: "knockrd6",
+		},
+		Webhooks: []*knockrd.WebhookConfig{
+			{URL: ts.URL, Secret: "secret"},
+		},
+	}
+	if err := knockrd.RunStreamEvent(conf, eventFile); err != nil {
+		t.Error(err)
+	}
+}
+
+// lockingWAF is a WAFv2 client which fails updates by WAFOptimisticLockException as many as conflicts.
+type lockingWAF struct {
+	wafv2iface.WAFV2API
+	addresses []string
+	conflicts int
+	err       error
+	updates   int
+}
+
+func (f *lockingWAF) GetIPSet(in *wafv2.GetIPSetInput) (*wafv2.GetIPSetOutput, error) {
+	return &wafv2.GetIPSetOutput{
+		IPSet:     &wafv2.IPSet{Id: in.Id, Name: in.Name, Addresses: aws.StringSlice(f.addresses)},
+		LockToken: aws.String("token"),
+	}, nil
+}
+
+func (f *lockingWAF) UpdateIPSet(in *wafv2.UpdateIPSetInput) (*wafv2.UpdateIPSetOutput, error) {
+	f.updates++
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.conflicts > 0 {
+		f.conflicts--
+		return nil, awserr.New(wafv2.ErrCodeWAFOptimisticLockException, "the lock token is stale", nil)
+	}
+	f.addresses = aws.StringValueSlice(in.Addresses)
+	sort.Strings(f.addresses)
+	return &wafv2.UpdateIPSetOutput{NextLockToken: aws.String("token")}, nil
+}
+
+func TestIsOptimisticLockError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		awserr.New(wafv2.ErrCodeWAFOptimisticLockException, "stale", nil): true,
+		awserr.New(wafv2.ErrCodeWAFLimitsExceededException, "limit", nil): false,
+		errors.New(wafv2.ErrCodeWAFOptimisticLockException):               false,
+	} {
+		if knockrd.IsOptimisticLockError(err) != expected {
+			t.Errorf("unexpected result for %s", err)
+		}
+	}
+	if knockrd.IsOptimisticLockError(nil) {
+		t.Error("nil is not a lock error")
+	}
+}
+
+func TestIPSetUpdateRetries(t *testing.T) {
+	var metrics bytes.Buffer
+	defer knockrd.SetMetricWriter(&metrics)()
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		IPSets: knockrd.IPSetsConfig{
+			V4: []*knockrd.IPSetConfig{{ID: "a", Name: "knockrd", Scope: "REGIONAL", Region: "us-east-1"}},
+		},
+	}
+	client := &lockingWAF{addresses: []string{"192.0.2.1/32"}, conflicts: 2}
+	handler := knockrd.NewStreamHandlerWithWAF(conf, client)
+	if err := handler(context.Background(), insertEvent("198.51.100.1")); err != nil {
+		t.Fatal(err)
+	}
+	if client.updates != 3 {
+		t.Errorf("unexpected updates %d", client.updates)
+	}
+	if a := strings.Join(client.addresses, ","); a != "192.0.2.1/32,198.51.100.1/32" {
+		t.Errorf("unexpected addresses %s", a)
+	}
+	var metric map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(metrics.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m["IPSetUpdateRetries"]; ok {
+			metric = m
+		}
+	}
+	if metric == nil || metric["IPSetUpdateRetries"] != float64(2) || metric["IPSet"] != "knockrd" || metric["Region"] != "us-east-1" {
+		t.Errorf("unexpected metrics %s", metrics.String())
+	}
+
+	// other errors are not retried
+	client = &lockingWAF{err: awserr.New(wafv2.ErrCodeWAFLimitsExceededException, "limit", nil)}
+	handler = knockrd.NewStreamHandlerWithWAF(conf, client)
+	if err := handler(context.Background(), insertEvent("198.51.100.1")); err == nil {
+		t.Error("expected an error")
+	}
+	// applied again to find the failed record
+	if client.updates != 2 {
+		t.Errorf("unexpected updates %d", client.updates)
+	}
+}
@@ -0,0 +1,393 @@
+package knockrd
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+var (
+	// DefaultStreamPollInterval is the default interval of polling idle shards.
+	DefaultStreamPollInterval = time.Second
+	// StreamShardsInterval is the interval of discovering new shards.
+	StreamShardsInterval = 30 * time.Second
+	// DefaultStreamMaxRetries is the default number of retries of a failed batch.
+	DefaultStreamMaxRetries = 10
+	// streamMaxRetryInterval is the max interval of retrying failed batches.
+	streamMaxRetryInterval = time.Minute
+)
+
+// streamConsumer consumes the DynamoDB stream without AWS Lambda.
+// Shards are processed in order of parents to children, so events for an item are handled in order.
+type streamConsumer struct {
+	client       dynamodbstreamsiface.DynamoDBStreamsAPI
+	streamARN    string
+	handler      func(context.Context, events.DynamoDBEvent) error
+	checkpoints  checkpointStore
+	pollInterval time.Duration
+	maxRetries   int
+
+	shards        map[string]*dynamodbstreams.Shard
+	iterators     map[string]*string
+	finished      map[string]bool
+	trimmed       map[string]bool
+	lastDescribed time.Time
+}
+
+func newStreamConsumer(conf *Config, handler func(context.Context, events.DynamoDBEvent) error) (*streamConsumer, error) {
+	streamARN := conf.Stream.StreamARN
+	if streamARN == "" {
+		db := dynamo.New(session.New(), conf.awsConfig(conf.AWS.Region))
+		desc, err := db.Table(conf.TableName).Describe().Run()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to describe table %s", conf.TableName)
+		}
+		if !desc.StreamEnabled || desc.LatestStreamARN == "" {
+			return nil, errors.Errorf("stream of table %s is not enabled", conf.TableName)
+		}
+		streamARN = desc.LatestStreamARN
+	}
+	var store checkpointStore
+	var err error
+	switch {
+	case conf.Stream.CheckpointTable != "":
+		store, err = newDynamoDBCheckpointStore(conf, conf.Stream.CheckpointTable, streamARN)
+	case conf.Stream.CheckpointFile != "":
+		store, err = newFileCheckpointStore(conf.Stream.CheckpointFile, streamARN)
+	default:
+		log.Println("[warn] checkpoints are not persisted. set stream.checkpoint_file or stream.checkpoint_table")
+		store = newMemoryCheckpointStore()
+	}
+	if err != nil {
+		return nil, err
+	}
+	client := dynamodbstreams.New(session.New(), conf.awsConfig(conf.AWS.Region))
+	c := newStreamConsumerWithClient(client, streamARN, handler, store, conf.Stream.PollInterval)
+	if conf.Stream.MaxRetries != 0 {
+		c.maxRetries = conf.Stream.MaxRetries
+	}
+	return c, nil
+}
+
+func newStreamConsumerWithClient(client dynamodbstreamsiface.DynamoDBStreamsAPI, streamARN string, handler func(context.Context, events.DynamoDBEvent) error, store checkpointStore, pollInterval time.Duration) *streamConsumer {
+	if pollInterval == 0 {
+		pollInterval = DefaultStreamPollInterval
+	}
+	return &streamConsumer{
+		client:       client,
+		streamARN:    streamARN,
+		handler:      handler,
+		checkpoints:  store,
+		pollInterval: pollInterval,
+		maxRetries:   DefaultStreamMaxRetries,
+		shards:       make(map[string]*dynamodbstreams.Shard),
+		iterators:    make(map[string]*string),
+		finished:     make(map[string]bool),
+		trimmed:      make(map[string]bool),
+	}
+}
+
+// runStreamConsumer runs the stream consumer until SIGINT or SIGTERM.
+func runStreamConsumer(conf *Config, handler func(context.Context, events.DynamoDBEvent) error) error {
+	c, err := newStreamConsumer(conf, handler)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("[info] received %s, shutting down", s)
+		cancel()
+	}()
+	log.Printf("[info] starting knockrd stream consumer for %s", c.streamARN)
+	return c.Run(ctx)
+}
+
+// Run polls the stream until the context is canceled.
+func (c *streamConsumer) Run(ctx context.Context) error {
+	for {
+		processed, err := c.poll(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Println("[error]", err)
+		}
+		if processed {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// poll reads a batch of records from each ready shard, and returns whether some records are processed.
+// A failure of a shard doesn't stop processing other shards.
+func (c *streamConsumer) poll(ctx context.Context) (bool, error) {
+	if time.Since(c.lastDescribed) > StreamShardsInterval {
+		if err := c.describeShards(ctx); err != nil {
+			return false, err
+		}
+	}
+	var processed bool
+	var errs []string
+	for _, shard := range c.readyShards() {
+		n, err := c.processShard(ctx, shard)
+		if err != nil {
+			if ctx.Err() != nil {
+				return processed, err
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		if n > 0 {
+			processed = true
+		}
+	}
+	if len(errs) > 0 {
+		return processed, errors.New(strings.Join(errs, ", "))
+	}
+	return processed, nil
+}
+
+// describeShards adds new shards of the stream, and prunes finished shards which are not in the stream anymore.
+func (c *streamConsumer) describeShards(ctx context.Context) error {
+	in := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(c.streamARN)}
+	listed := make(map[string]bool)
+	for {
+		out, err := c.client.DescribeStreamWithContext(ctx, in)
+		if err != nil {
+			return errors.Wrapf(err, "failed to describe stream %s", c.streamARN)
+		}
+		for _, shard := range out.StreamDescription.Shards {
+			id := aws.StringValue(shard.ShardId)
+			listed[id] = true
+			if _, ok := c.shards[id]; ok {
+				continue
+			}
+			seq, err := c.checkpoints.Load(id)
+			if err != nil {
+				return err
+			}
+			log.Printf("[debug] found shard %s parent:%s checkpoint:%s", id, aws.StringValue(shard.ParentShardId), seq)
+			c.shards[id] = shard
+			c.finished[id] = seq == checkpointShardEnd
+		}
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			break
+		}
+		in.ExclusiveStartShardId = out.StreamDescription.LastEvaluatedShardId
+	}
+	c.pruneShards(listed)
+	c.lastDescribed = time.Now()
+	return nil
+}
+
+// pruneShards forgets finished shards which are not listed in the stream (trimmed after 24 hours) and whose children are found.
+// Children without known parents are ready to process, so they are not blocked.
+func (c *streamConsumer) pruneShards(listed map[string]bool) {
+	hasChildren := make(map[string]bool)
+	for _, shard := range c.shards {
+		hasChildren[aws.StringValue(shard.ParentShardId)] = true
+	}
+	for id := range c.shards {
+		if !c.finished[id] || listed[id] || !hasChildren[id] {
+			continue
+		}
+		log.Printf("[debug] prune shard %s", id)
+		delete(c.shards, id)
+		delete(c.finished, id)
+		delete(c.iterators, id)
+		delete(c.trimmed, id)
+	}
+}
+
+// readyShards returns unfinished shards whose parents are finished (or trimmed from the stream).
+func (c *streamConsumer) readyShards() []*dynamodbstreams.Shard {
+	var shards []*dynamodbstreams.Shard
+	for id, shard := range c.shards {
+		if c.finished[id] {
+			continue
+		}
+		parent := aws.StringValue(shard.ParentShardId)
+		if _, known := c.shards[parent]; parent != "" && known && !c.finished[parent] {
+			continue
+		}
+		shards = append(shards, shard)
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return aws.StringValue(shards[i].ShardId) < aws.StringValue(shards[j].ShardId)
+	})
+	return shards
+}
+
+func (c *streamConsumer) shardIterator(ctx context.Context, id string) (*string, error) {
+	in := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn: aws.String(c.streamARN),
+		ShardId:   aws.String(id),
+	}
+	seq, err := c.checkpoints.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if seq != "" && !c.trimmed[id] {
+		in.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		in.SequenceNumber = aws.String(seq)
+	} else {
+		in.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon)
+	}
+	out, err := c.client.GetShardIteratorWithContext(ctx, in)
+	if aws.StringValue(in.ShardIteratorType) == dynamodbstreams.ShardIteratorTypeAfterSequenceNumber &&
+		(isAWSErrorCode(err, dynamodbstreams.ErrCodeTrimmedDataAccessException) || isAWSErrorCode(err, dynamodbstreams.ErrCodeExpiredIteratorException)) {
+		log.Printf("[warn] the checkpoint %s of %s is trimmed, reading from the oldest record", seq, id)
+		in.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon)
+		in.SequenceNumber = nil
+		out, err = c.client.GetShardIteratorWithContext(ctx, in)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get shard iterator of %s", id)
+	}
+	delete(c.trimmed, id)
+	return out.ShardIterator, nil
+}
+
+// processShard handles a batch of records in the shard, and returns the number of records.
+func (c *streamConsumer) processShard(ctx context.Context, shard *dynamodbstreams.Shard) (int, error) {
+	id := aws.StringValue(shard.ShardId)
+	it := c.iterators[id]
+	if it == nil {
+		var err error
+		if it, err = c.shardIterator(ctx, id); err != nil {
+			return 0, err
+		}
+	}
+	out, err := c.client.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{
+		ShardIterator: it,
+	})
+	switch {
+	case isAWSErrorCode(err, dynamodbstreams.ErrCodeExpiredIteratorException):
+		log.Printf("[info] iterator of %s is expired, renewing", id)
+		delete(c.iterators, id)
+		return 0, nil
+	case isAWSErrorCode(err, dynamodbstreams.ErrCodeTrimmedDataAccessException):
+		log.Printf("[warn] records after the checkpoint of %s are trimmed, reading from the oldest record", id)
+		delete(c.iterators, id)
+		c.trimmed[id] = true
+		return 0, nil
+	case isAWSErrorCode(err, dynamodbstreams.ErrCodeLimitExceededException):
+		log.Printf("[warn] reading %s is throttled", id)
+		c.iterators[id] = it
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrapf(err, "failed to get records of %s", id)
+	}
+
+	if len(out.Records) > 0 {
+		ev, err := newDynamoDBEvent(c.streamARN, out.Records)
+		if err != nil {
+			return 0, err
+		}
+		if err := c.handle(ctx, id, ev); err != nil {
+			return 0, err
+		}
+		last := out.Records[len(out.Records)-1]
+		if err := c.checkpoints.Save(id, aws.StringValue(last.Dynamodb.SequenceNumber)); err != nil {
+			return 0, err
+		}
+	}
+	if out.NextShardIterator == nil {
+		log.Printf("[info] shard %s is finished", id)
+		if err := c.checkpoints.Save(id, checkpointShardEnd); err != nil {
+			return 0, err
+		}
+		c.finished[id] = true
+		delete(c.iterators, id)
+	} else {
+		c.iterators[id] = out.NextShardIterator
+	}
+	return len(out.Records), nil
+}
+
+// handle calls the handler until it succeeds as Lambda retries batches of the stream.
+// When the handler reports a failed record, records before it are checkpointed and the rest are retried.
+// After maxRetries retries (negative means infinite), the rest of records are logged and skipped.
+func (c *streamConsumer) handle(ctx context.Context, id string, ev events.DynamoDBEvent) error {
+	wait := c.pollInterval
+	for retries := 0; ; retries++ {
+		log.Printf("[debug] handling %d records of %s", len(ev.Records), id)
+		err := c.handler(ctx, ev)
+		if err == nil {
+			return nil
+		}
+		var bf *batchItemFailureError
+		if errors.As(err, &bf) {
+			for i, r := range ev.Records {
+				if r.Change.SequenceNumber != bf.sequenceNumber || i == 0 {
+					continue
+				}
+				if err := c.checkpoints.Save(id, ev.Records[i-1].Change.SequenceNumber); err != nil {
+					return err
+				}
+				ev.Records = ev.Records[i:]
+				break
+			}
+		}
+		if c.maxRetries >= 0 && retries >= c.maxRetries {
+			log.Printf("[error] failed to handle records of %s after %d retries, skipping: %s", id, retries, err)
+			for _, r := range ev.Records {
+				log.Printf("[error] skipped record %s %s %s", r.EventName, r.Change.Keys["Key"].String(), r.Change.SequenceNumber)
+			}
+			return nil
+		}
+		log.Printf("[error] failed to handle records of %s, retrying after %s: %s", id, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > streamMaxRetryInterval {
+			wait = streamMaxRetryInterval
+		}
+	}
+}
+
+// newDynamoDBEvent converts records of DynamoDB Streams API to an event for Lambda.
+func newDynamoDBEvent(streamARN string, records []*dynamodbstreams.Record) (events.DynamoDBEvent, error) {
+	ev := events.DynamoDBEvent{
+		Records: make([]events.DynamoDBEventRecord, 0, len(records)),
+	}
+	for _, r := range records {
+		b, err := jsonutil.BuildJSON(r)
+		if err != nil {
+			return ev, errors.Wrap(err, "failed to marshal a record")
+		}
+		var er events.DynamoDBEventRecord
+		if err := json.Unmarshal(b, &er); err != nil {
+			return ev, errors.Wrap(err, "failed to unmarshal a record")
+		}
+		er.EventSourceArn = streamARN
+		ev.Records = append(ev.Records, er)
+	}
+	return ev, nil
+}
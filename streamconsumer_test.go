@@ -0,0 +1,296 @@
+package knockrd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/fujiwara/knockrd"
+)
+
+const testStreamARN = "arn:aws:dynamodb:us-east-1:123456789012:table/knockrd/stream/2020-05-01T00:00:00.000"
+
+// fakeStreams serves shards whose records are read one by one.
+// Iterators are "{shard id}:{position}".
+type fakeStreams struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+	shards    []*dynamodbstreams.Shard
+	records   map[string][]*dynamodbstreams.Record
+	closed    map[string]bool
+	trimmed   map[string]bool  // checkpoints of the shards are trimmed
+	errs      map[string]error // errors of GetRecords for the shards
+	iterators []string
+}
+
+func (f *fakeStreams) DescribeStreamWithContext(_ aws.Context, in *dynamodbstreams.DescribeStreamInput, _ ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+	// a shard for each page
+	i := 0
+	if in.ExclusiveStartShardId != nil {
+		for j, s := range f.shards {
+			if aws.StringValue(s.ShardId) == aws.StringValue(in.ExclusiveStartShardId) {
+				i = j + 1
+			}
+		}
+	}
+	desc := &dynamodbstreams.StreamDescription{Shards: f.shards[i : i+1]}
+	if i+1 < len(f.shards) {
+		desc.LastEvaluatedShardId = f.shards[i].ShardId
+	}
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: desc}, nil
+}
+
+func (f *fakeStreams) GetShardIteratorWithContext(_ aws.Context, in *dynamodbstreams.GetShardIteratorInput, _ ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	id := aws.StringValue(in.ShardId)
+	f.iterators = append(f.iterators, strings.TrimSpace(fmt.Sprintf("%s %s %s", id, aws.StringValue(in.ShardIteratorType), aws.StringValue(in.SequenceNumber))))
+	pos := 0
+	if aws.StringValue(in.ShardIteratorType) == dynamodbstreams.ShardIteratorTypeAfterSequenceNumber {
+		if f.trimmed[id] {
+			return nil, awserr.New(dynamodbstreams.ErrCodeTrimmedDataAccessException, "trimmed", nil)
+		}
+		for i, r := range f.records[id] {
+			if aws.StringValue(r.Dynamodb.SequenceNumber) == aws.StringValue(in.SequenceNumber) {
+				pos = i + 1
+			}
+		}
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s:%d", id, pos))}, nil
+}
+
+func (f *fakeStreams) GetRecordsWithContext(_ aws.Context, in *dynamodbstreams.GetRecordsInput, _ ...request.Option) (*dynamodbstreams.GetRecordsOutput, error) {
+	p := strings.SplitN(aws.StringValue(in.ShardIterator), ":", 2)
+	id := p[0]
+	pos, _ := strconv.Atoi(p[1])
+	if err := f.errs[id]; err != nil {
+		return nil, err
+	}
+	out := &dynamodbstreams.GetRecordsOutput{}
+	if pos < len(f.records[id]) {
+		out.Records = f.records[id][pos : pos+1]
+		pos++
+	}
+	if pos < len(f.records[id]) || !f.closed[id] {
+		out.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", id, pos))
+	}
+	return out, nil
+}
+
+func testStreamRecord(name, key, seq string) *dynamodbstreams.Record {
+	return &dynamodbstreams.Record{
+		EventName: aws.String(name),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			Keys:           map[string]*dynamodb.AttributeValue{"Key": {S: aws.String(key)}},
+			SequenceNumber: aws.String(seq),
+		},
+	}
+}
+
+func TestStreamConsumer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoints.json")
+
+	f := &fakeStreams{
+		// a child shard is listed before the parent
+		shards: []*dynamodbstreams.Shard{
+			{ShardId: aws.String("shardId-002"), ParentShardId: aws.String("shardId-001")},
+			{ShardId: aws.String("shardId-001")},
+		},
+		records: map[string][]*dynamodbstreams.Record{
+			"shardId-001": {
+				testStreamRecord("INSERT", "198.51.100.1", "100"),
+				testStreamRecord("MODIFY", "198.51.100.1", "200"),
+			},
+			"shardId-002": {
+				testStreamRecord("REMOVE", "198.51.100.1", "300"),
+			},
+		},
+		closed: map[string]bool{"shardId-001": true},
+	}
+	var handled []string
+	var failed bool
+	handler := func(_ context.Context, ev events.DynamoDBEvent) error {
+		if !failed {
+			// retried
+			failed = true
+			return errors.New("failed")
+		}
+		for _, r := range ev.Records {
+			if r.EventSourceArn != testStreamARN {
+				t.Errorf("unexpected event source %s", r.EventSourceArn)
+			}
+			handled = append(handled, r.EventName+" "+r.Change.Keys["Key"].String()+" "+r.Change.SequenceNumber)
+		}
+		return nil
+	}
+	c, err := knockrd.NewStreamConsumerWithFile(f, testStreamARN, handler, checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if _, err := c.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		"INSERT 198.51.100.1 100",
+		"MODIFY 198.51.100.1 200",
+		"REMOVE 198.51.100.1 300",
+	}
+	if strings.Join(handled, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected handled records %#v", handled)
+	}
+
+	// restart from checkpoints
+	f.iterators = nil
+	handled = nil
+	c, err = knockrd.NewStreamConsumerWithFile(f, testStreamARN, handler, checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed, err := c.Poll(ctx); err != nil {
+		t.Fatal(err)
+	} else if processed || len(handled) > 0 {
+		t.Errorf("records are handled again %#v", handled)
+	}
+	if its := strings.Join(f.iterators, "\n"); its != "shardId-002 AFTER_SEQUENCE_NUMBER 300" {
+		t.Errorf("unexpected iterators %s", its)
+	}
+}
+
+func TestStreamConsumerFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoints.json")
+	if err := ioutil.WriteFile(checkpointFile, []byte(`{"stream_arn":"`+testStreamARN+`","shards":{"shardId-001":{"sequence_number":"50"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeStreams{
+		shards: []*dynamodbstreams.Shard{
+			{ShardId: aws.String("shardId-001")},
+			{ShardId: aws.String("shardId-002")},
+			{ShardId: aws.String("shardId-003")},
+		},
+		records: map[string][]*dynamodbstreams.Record{
+			"shardId-001": {
+				testStreamRecord("INSERT", "198.51.100.1", "100"),
+			},
+			"shardId-002": {
+				testStreamRecord("INSERT", "198.51.100.2", "200"),
+			},
+			"shardId-003": {
+				testStreamRecord("INSERT", "198.51.100.3", "300"),
+				testStreamRecord("INSERT", "198.51.100.4", "400"),
+			},
+		},
+		closed:  map[string]bool{"shardId-001": true, "shardId-002": true, "shardId-003": true},
+		trimmed: map[string]bool{"shardId-001": true},
+		errs:    map[string]error{"shardId-002": errors.New("unavailable")},
+	}
+	var handled []string
+	var calls int
+	handler := func(_ context.Context, ev events.DynamoDBEvent) error {
+		for _, r := range ev.Records {
+			if r.Change.Keys["Key"].String() == "198.51.100.3" {
+				calls++
+				return errors.New("failed")
+			}
+			handled = append(handled, r.Change.Keys["Key"].String())
+		}
+		return nil
+	}
+	c, err := knockrd.NewStreamConsumerWithFile(f, testStreamARN, handler, checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetMaxRetries(2)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := c.Poll(ctx)
+		if err == nil || !strings.Contains(err.Error(), "unavailable") {
+			t.Errorf("an error of shardId-002 is expected %v", err)
+		}
+	}
+	// the trimmed checkpoint falls back to the oldest record
+	if its := strings.Join(f.iterators[:2], ","); its != "shardId-001 AFTER_SEQUENCE_NUMBER 50,shardId-001 TRIM_HORIZON" {
+		t.Errorf("unexpected iterators %#v", f.iterators)
+	}
+	// the failed record is skipped after retries, and the failed shard doesn't block others
+	if calls != 3 {
+		t.Errorf("unexpected calls %d", calls)
+	}
+	if h := strings.Join(handled, ","); h != "198.51.100.1,198.51.100.4" {
+		t.Errorf("unexpected handled records %s", h)
+	}
+}
+
+func TestStreamConsumerPruneShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	interval := knockrd.StreamShardsInterval
+	knockrd.StreamShardsInterval = 0
+	defer func() { knockrd.StreamShardsInterval = interval }()
+
+	f := &fakeStreams{
+		shards: []*dynamodbstreams.Shard{
+			{ShardId: aws.String("shardId-001")},
+			{ShardId: aws.String("shardId-002"), ParentShardId: aws.String("shardId-001")},
+		},
+		records: map[string][]*dynamodbstreams.Record{
+			"shardId-001": {
+				testStreamRecord("INSERT", "198.51.100.1", "100"),
+			},
+		},
+		closed: map[string]bool{"shardId-001": true},
+	}
+	handler := func(_ context.Context, ev events.DynamoDBEvent) error {
+		return nil
+	}
+	c, err := knockrd.NewStreamConsumerWithFile(f, testStreamARN, handler, filepath.Join(dir, "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := c.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the finished shard is kept while it is listed in the stream
+	if _, err := c.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ids := strings.Join(c.ShardIDs(), ","); ids != "shardId-001,shardId-002" {
+		t.Errorf("unexpected shards %s", ids)
+	}
+
+	// the finished shard is trimmed from the stream
+	f.shards = f.shards[1:]
+	if _, err := c.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ids := strings.Join(c.ShardIDs(), ","); ids != "shardId-002" {
+		t.Errorf("unexpected shards %s", ids)
+	}
+}
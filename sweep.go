@@ -0,0 +1,159 @@
+package knockrd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+// sweeperLockKey is a key of the item for leader election of sweepers.
+// The key is not an IP address, so the item is ignored by targets.
+const sweeperLockKey = noCachePrefix + "knockrd_sweeper_lock"
+
+// sweeperLock is an item which holds the leadership of sweepers until Expires.
+type sweeperLock struct {
+	Key     string `dynamo:"Key,hash"`
+	Expires int64  `dynamo:"Expires"`
+	Owner   string `dynamo:"Owner"`
+}
+
+// Sweep deletes items which are expired but not deleted by DynamoDB TTL yet, and returns the deleted items.
+// Items are deleted conditionally, so items extended after the scan are kept.
+func (d *DynamoDBBackend) Sweep(ctx context.Context) ([]Item, error) {
+	table := d.db.Table(d.TableName)
+	now := time.Now().Unix()
+	var items []Item
+	log.Printf("[debug] scan expired items in %s", d.TableName)
+	if err := table.Scan().Filter("'Expires' < ?", now).AllWithContext(ctx, &items); err != nil {
+		return nil, errors.Wrapf(err, "failed to scan %s", d.TableName)
+	}
+	deleted := make([]Item, 0, len(items))
+	for _, item := range items {
+		if item.Key == sweeperLockKey {
+			continue
+		}
+		err := table.Delete("Key", item.Key).If("'Expires' < ?", now).RunWithContext(ctx)
+		if isAWSErrorCode(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			log.Printf("[debug] %s is extended, skipped", item.Key)
+			continue
+		} else if err != nil {
+			return deleted, errors.Wrapf(err, "failed to delete %s", item.Key)
+		}
+		log.Printf("[info] %s expired at %s is deleted", item.Key, time.Unix(item.Expires, 0).Format(time.RFC3339))
+		deleted = append(deleted, item)
+		if d.OnExpire != nil {
+			d.OnExpire(item)
+		}
+	}
+	return deleted, nil
+}
+
+// acquireSweeperLock takes or renews the leadership of sweepers for ttl.
+// It returns false when another owner holds the lock.
+func (d *DynamoDBBackend) acquireSweeperLock(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lock := sweeperLock{
+		Key:     sweeperLockKey,
+		Expires: now.Add(ttl).Unix(),
+		Owner:   owner,
+	}
+	err := d.db.Table(d.TableName).Put(lock).
+		If("attribute_not_exists('Key') OR 'Expires' < ? OR 'Owner' = ?", now.Unix(), owner).
+		RunWithContext(ctx)
+	if isAWSErrorCode(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "failed to acquire the sweeper lock")
+	}
+	return true, nil
+}
+
+// sweeper deletes expired items periodically. Only one of sweepers which holds the lock sweeps at once.
+type sweeper struct {
+	backend  *DynamoDBBackend
+	owner    string
+	interval time.Duration
+}
+
+func newSweeper(b *DynamoDBBackend, interval time.Duration) *sweeper {
+	if interval == 0 {
+		interval = DefaultSweepInterval
+	}
+	host, _ := os.Hostname()
+	return &sweeper{
+		backend:  b,
+		owner:    fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano()),
+		interval: interval,
+	}
+}
+
+// run sweeps until the context is canceled.
+func (s *sweeper) run(ctx context.Context) {
+	log.Printf("[info] starting sweeper %s interval:%s", s.owner, s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.sweep(ctx); err != nil && ctx.Err() == nil {
+			log.Println("[error]", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep sweeps expired items when the sweeper is a leader.
+// The lock expires after two intervals, so another sweeper takes over when the leader stops.
+func (s *sweeper) sweep(ctx context.Context) error {
+	ok, err := s.backend.acquireSweeperLock(ctx, s.owner, 2*s.interval)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Println("[debug] another sweeper is a leader")
+		return nil
+	}
+	_, err = s.backend.Sweep(ctx)
+	return err
+}
+
+// NewSweepHandler creates a handler function for sweeping expired items by scheduled events.
+func NewSweepHandler(conf *Config) (func(context.Context, events.CloudWatchEvent) error, error) {
+	b, err := NewDynamoDBBackend(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, _ events.CloudWatchEvent) error {
+		_, err := b.(*DynamoDBBackend).Sweep(ctx)
+		return err
+	}, nil
+}
+
+// runSweeper runs the sweeper until SIGINT or SIGTERM.
+func runSweeper(conf *Config) error {
+	b, err := NewDynamoDBBackend(conf)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("[info] received %s, shutting down", s)
+		cancel()
+	}()
+	newSweeper(b.(*DynamoDBBackend), conf.Sweeper.Interval).run(ctx)
+	return nil
+}
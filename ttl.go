@@ -0,0 +1,66 @@
+package knockrd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TTLPolicies is a list of TTL policies. The first policy which matches an identity is applied.
+type TTLPolicies []*TTLPolicy
+
+// maxTTL returns the max duration of allowances for the identity.
+// The default TTL is the max for identities which match no policies.
+func (ps TTLPolicies) maxTTL(identity string, ttl time.Duration) time.Duration {
+	for _, p := range ps {
+		if p.match(identity) {
+			return p.MaxTTL
+		}
+	}
+	return ttl
+}
+
+// allowanceTTL returns a duration of the allowance requested by s.
+// An empty s means the default TTL, which is shortened to the max.
+func allowanceTTL(s string, ttl, max time.Duration) (time.Duration, error) {
+	if s == "" {
+		if ttl > max {
+			return max, nil
+		}
+		return ttl, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %s", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %s", s)
+	}
+	if d > max {
+		return 0, fmt.Errorf("duration %s exceeds the max %s", formatDuration(d), formatDuration(max))
+	}
+	return d, nil
+}
+
+// formatDuration formats the duration without zero units (e.g. 12h, 1h30m).
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// maxTTL returns the longest duration of allowances.
+func (c *Config) maxTTL() time.Duration {
+	max := c.TTL
+	for _, p := range c.TTLPolicies {
+		if p.MaxTTL > max {
+			max = p.MaxTTL
+		}
+	}
+	return max
+}
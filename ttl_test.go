@@ -0,0 +1,82 @@
+package knockrd_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fujiwara/knockrd"
+)
+
+func testAllowDuration(t *testing.T, identity, duration string) (int, time.Duration) {
+	t.Helper()
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	conf := &knockrd.Config{
+		TTLChoices: []time.Duration{time.Hour, 4 * time.Hour, 12 * time.Hour},
+		TTLPolicies: knockrd.TTLPolicies{
+			{Identities: []string{"oncall@example.com"}, MaxTTL: 12 * time.Hour},
+			{EmailDomains: []string{"contractor.example.com"}, MaxTTL: 30 * time.Minute},
+		},
+	}
+	allow, _ := knockrd.NewHTTPHandlers(b, conf, identity)
+	_, token := getAllow(t, allow, "198.51.100.1")
+	form := url.Values{"csrf_token": {token}, "allow": {"allow"}}
+	if duration != "" {
+		form.Set("duration", duration)
+	}
+	w := postAllow(allow, "198.51.100.1", form)
+	items, _ := b.List()
+	for _, item := range items {
+		if item.Key == "198.51.100.1" {
+			return w.Code, time.Until(time.Unix(item.Expires, 0)).Round(time.Minute)
+		}
+	}
+	return w.Code, 0
+}
+
+func TestAllowDuration(t *testing.T) {
+	testCases := []struct {
+		identity string
+		duration string
+		code     int
+		ttl      time.Duration
+	}{
+		{"oncall@example.com", "12h", http.StatusOK, 12 * time.Hour},
+		{"oncall@example.com", "", http.StatusOK, time.Hour},
+		{"oncall@example.com", "13h", http.StatusBadRequest, 0},
+		{"foo@contractor.example.com", "", http.StatusOK, 30 * time.Minute},
+		{"foo@contractor.example.com", "1h", http.StatusBadRequest, 0},
+		{"foo@example.net", "1h", http.StatusOK, time.Hour},
+		{"foo@example.net", "4h", http.StatusBadRequest, 0},
+		{"foo@example.net", "-1h", http.StatusBadRequest, 0},
+		{"foo@example.net", "xxx", http.StatusBadRequest, 0},
+	}
+	for _, tc := range testCases {
+		code, ttl := testAllowDuration(t, tc.identity, tc.duration)
+		if code != tc.code || ttl != tc.ttl {
+			t.Errorf("%s %s: unexpected result %d %s", tc.identity, tc.duration, code, ttl)
+		}
+	}
+}
+
+func TestAllowDurationChoices(t *testing.T) {
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	conf := &knockrd.Config{
+		TTLChoices: []time.Duration{30 * time.Minute, time.Hour, 12 * time.Hour},
+		TTLPolicies: knockrd.TTLPolicies{
+			{Identities: []string{"*"}, MaxTTL: 4 * time.Hour},
+		},
+	}
+	allow, _ := knockrd.NewHTTPHandlers(b, conf, "foo@example.com")
+	body, _ := getAllow(t, allow, "198.51.100.1")
+	for _, s := range []string{`<option value="30m">`, `<option value="1h" selected>`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%s is not found in %s", s, body)
+		}
+	}
+	if strings.Contains(body, "12h") {
+		t.Errorf("12h must not be a choice %s", body)
+	}
+}
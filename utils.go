@@ -16,3 +16,12 @@ func JSONString(s interface{}) string {
 	b, _ := marshalJSON(s)
 	return string(b)
 }
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
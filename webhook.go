@@ -0,0 +1,164 @@
+package knockrd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shogo82148/go-retry"
+)
+
+// Headers of webhook requests
+const (
+	WebhookSignatureHeader = "X-Knockrd-Signature"
+	WebhookTimestampHeader = "X-Knockrd-Timestamp"
+)
+
+// WebhookEvent represents a body of webhook requests.
+type WebhookEvent struct {
+	Action   string     `json:"action"` // add or remove
+	IP       string     `json:"ip"`     // a network in CIDR notation for a widened allowance
+	CIDR     string     `json:"cidr"`
+	Service  string     `json:"service,omitempty"`
+	Identity string     `json:"identity,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+func newWebhookEvent(ev ipSetEvent) WebhookEvent {
+	wev := WebhookEvent{
+		Action:   addOrRemove(ev.add),
+		IP:       ev.address,
+		CIDR:     ev.CIDR(),
+		Service:  ev.service,
+		Identity: ev.identity,
+	}
+	if !ev.expires.IsZero() {
+		expires := ev.expires.UTC()
+		wev.Expires = &expires
+	}
+	return wev
+}
+
+const sentWebhooksContextKey contextKey = "sentWebhooks"
+
+// sentWebhooks records webhooks sent in an invocation of the handler,
+// so records applied again after a failure don't send them twice.
+type sentWebhooks struct {
+	mu   sync.Mutex
+	sent map[string]bool
+}
+
+func withSentWebhooks(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sentWebhooksContextKey, &sentWebhooks{sent: make(map[string]bool)})
+}
+
+func sentWebhooksFromContext(ctx context.Context) *sentWebhooks {
+	sw, _ := ctx.Value(sentWebhooksContextKey).(*sentWebhooks)
+	return sw
+}
+
+func (sw *sentWebhooks) contains(key string) bool {
+	if sw == nil {
+		return false
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.sent[key]
+}
+
+func (sw *sentWebhooks) add(key string) {
+	if sw == nil {
+		return
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.sent[key] = true
+}
+
+// WebhookSignature returns a signature of the body at the timestamp.
+// The signature is "sha256=" + hex encoded HMAC-SHA256 of "{timestamp}.{body}" by the secret.
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *streamer) sendWebhook(ctx context.Context, c *WebhookConfig, v4Events []ipSetEvent, v6Events []ipSetEvent) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	sent := sentWebhooksFromContext(ctx)
+	for _, ev := range latestEvents(v4Events, v6Events) {
+		body, err := json.Marshal(newWebhookEvent(ev))
+		if err != nil {
+			return err
+		}
+		key := c.URL + " " + string(body)
+		if sent.contains(key) {
+			log.Printf("[debug] a webhook to %s %s %s is already sent", c.URL, addOrRemove(ev.add), ev.CIDR())
+			continue
+		}
+		if s.skipByDryRun("send a webhook to %s %s", c.URL, string(body)) {
+			continue
+		}
+		err = retryPolicy.Do(ctx, func() error {
+			return c.post(ctx, client, body)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to send a webhook to %s", c.URL)
+		}
+		sent.add(key)
+		log.Printf("[info] sent a webhook to %s %s %s", c.URL, addOrRemove(ev.add), ev.CIDR())
+	}
+	return nil
+}
+
+// post sends the body. Errors are retryable except for client errors (4xx without 429).
+func (c *WebhookConfig) post(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return retry.MarkPermanent(err)
+	}
+	req = req.WithContext(ctx)
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	// signed at each attempt to keep the timestamp fresh
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "knockrd")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(c.Secret, timestamp, body))
+	log.Printf("[debug] POST %s %s", c.URL, string(body))
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("[warn] POST %s failed, retrying: %s", c.URL, err)
+		return err
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		log.Printf("[warn] POST %s returned %d, retrying", c.URL, res.StatusCode)
+		return fmt.Errorf("POST %s returned %d: %s", c.URL, res.StatusCode, string(b))
+	default:
+		return retry.MarkPermanent(fmt.Errorf("POST %s returned %d: %s", c.URL, res.StatusCode, string(b)))
+	}
+}
@@ -0,0 +1,123 @@
+package knockrd_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get("X-Knockrd-Timestamp") + "." + string(body)))
+		if sig := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Knockrd-Signature") != sig {
+			t.Errorf("invalid signature %s", r.Header.Get("X-Knockrd-Signature"))
+		}
+		if r.Header.Get("X-Token") != "foo" {
+			t.Errorf("unexpected header %s", r.Header.Get("X-Token"))
+		}
+		if requests == 1 {
+			// retried
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		bodies = append(bodies, string(body))
+	}))
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Webhooks: []*knockrd.WebhookConfig{
+			{URL: ts.URL, Secret: "secret", Headers: map[string]string{"X-Token": "foo"}},
+		},
+	}
+	handler := knockrd.NewStreamHandler(conf)
+	var ev events.DynamoDBEvent
+	if err := json.Unmarshal(dynamoDBStreamEventJSON, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		`{"action":"remove","ip":"198.51.100.1","cidr":"198.51.100.1/32"}`,
+		`{"action":"add","ip":"198.51.100.123","cidr":"198.51.100.123/32"}`,
+		`{"action":"add","ip":"2001:db8::1","cidr":"2001:db8::1/128"}`,
+	}
+	if strings.Join(bodies, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected bodies %#v", bodies)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	sig := knockrd.WebhookSignature("secret", "1588291200", []byte(`{"action":"add"}`))
+	if !strings.HasPrefix(sig, "sha256=") || len(sig) != len("sha256=")+64 {
+		t.Errorf("unexpected signature %s", sig)
+	}
+	if sig == knockrd.WebhookSignature("secret", "1588291201", []byte(`{"action":"add"}`)) {
+		t.Error("signature must depend on the timestamp")
+	}
+}
+
+func TestWebhookFailure(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if strings.Contains(string(body), "198.51.100.2") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Webhooks: []*knockrd.WebhookConfig{
+			{URL: ts.URL, Secret: "secret"},
+		},
+	}
+	handler := knockrd.NewStreamHandler(conf)
+	ev := insertEvent("198.51.100.1", "198.51.100.2", "198.51.100.3")
+	res, err := knockrd.NewBatchItemFailuresHandler(handler)(context.Background(), ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.BatchItemFailures) != 1 || res.BatchItemFailures[0].ItemIdentifier != "2" {
+		t.Errorf("unexpected batch item failures %#v", res.BatchItemFailures)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// the first event is not sent again when records are applied one by one
+	expected := []string{
+		`{"action":"add","ip":"198.51.100.1","cidr":"198.51.100.1/32"}`,
+		`{"action":"add","ip":"198.51.100.2","cidr":"198.51.100.2/32"}`,
+		`{"action":"add","ip":"198.51.100.2","cidr":"198.51.100.2/32"}`,
+	}
+	if strings.Join(bodies, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected bodies %#v", bodies)
+	}
+}
@@ -0,0 +1,88 @@
+package knockrd
+
+import (
+	"net"
+	"sort"
+)
+
+// WideningPolicies is a list of widening policies. The first policy which matches an identity is applied.
+type WideningPolicies []*WideningPolicy
+
+// prefixLength returns the prefix length of allowances for the identity.
+func (ps WideningPolicies) prefixLength(identity string, v4 bool) int {
+	for _, p := range ps {
+		if p.match(identity) {
+			return p.prefixLength(v4)
+		}
+	}
+	return maxPrefixLength(v4)
+}
+
+func (p *WideningPolicy) prefixLength(v4 bool) int {
+	length := p.IPv6PrefixLength
+	if v4 {
+		length = p.IPv4PrefixLength
+	}
+	if length == 0 {
+		return maxPrefixLength(v4)
+	}
+	return length
+}
+
+// allowKey returns the key in the backend of an allowance for the address.
+// The key is a network in CIDR notation when the allowance is widened by a policy.
+func (ps WideningPolicies) allowKey(ipaddr, identity string) string {
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
+		return ipaddr
+	}
+	v4 := ip.To4() != nil
+	length := ps.prefixLength(identity, v4)
+	if length == maxPrefixLength(v4) {
+		return ipaddr
+	}
+	return networkKey(ip, length)
+}
+
+// lookupKeys returns keys in the backend which allow the address.
+// These are the address itself and networks of prefix lengths used by policies, from the narrowest.
+func (ps WideningPolicies) lookupKeys(ipaddr string) []string {
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
+		return []string{ipaddr}
+	}
+	v4 := ip.To4() != nil
+	lengths := make([]int, 0, len(ps))
+	seen := map[int]bool{maxPrefixLength(v4): true}
+	for _, p := range ps {
+		length := p.prefixLength(v4)
+		if !seen[length] {
+			seen[length] = true
+			lengths = append(lengths, length)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+	keys := []string{ipaddr}
+	for _, length := range lengths {
+		keys = append(keys, networkKey(ip, length))
+	}
+	return keys
+}
+
+func maxPrefixLength(v4 bool) int {
+	if v4 {
+		return 32
+	}
+	return 128
+}
+
+// networkKey returns a key for the network of the IP address.
+func networkKey(ip net.IP, length int) string {
+	bits := 128
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip, bits = ipv4, 32
+	}
+	mask := net.CIDRMask(length, bits)
+	n := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return n.String()
+}
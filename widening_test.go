@@ -0,0 +1,142 @@
+package knockrd_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fujiwara/knockrd"
+)
+
+func TestWidenedAllowance(t *testing.T) {
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	conf := &knockrd.Config{
+		Widening: knockrd.WideningPolicies{
+			{EmailDomains: []string{"example.com"}, IPv4PrefixLength: 24, IPv6PrefixLength: 64},
+		},
+	}
+	allow, auth := knockrd.NewHTTPHandlers(b, conf, "alice@example.com")
+
+	body, token := getAllow(t, allow, "198.51.100.10")
+	if !strings.Contains(body, "198.51.100.0/24") {
+		t.Errorf("widened network is not shown %s", body)
+	}
+	if w := postAllow(allow, "198.51.100.10", url.Values{"csrf_token": {token}, "allow": {"allow"}}); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if ok, _ := b.Get("198.51.100.0/24"); !ok {
+		t.Error("198.51.100.0/24 is not allowed")
+	}
+	if ok, _ := b.Get("198.51.100.10"); ok {
+		t.Error("198.51.100.10 must not be stored")
+	}
+
+	for ip, code := range map[string]int{
+		"198.51.100.10":  http.StatusOK,
+		"198.51.100.200": http.StatusOK,
+		"198.51.101.1":   http.StatusForbidden,
+		"2001:db8::1":    http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		req.Header.Set("X-Real-IP", ip)
+		w := httptest.NewRecorder()
+		auth(w, req)
+		if w.Code != code {
+			t.Errorf("unexpected status %d for %s", w.Code, ip)
+		}
+	}
+}
+
+func TestNotWidenedAllowance(t *testing.T) {
+	b, _ := knockrd.NewMemoryBackend(&knockrd.Config{TTL: time.Hour})
+	conf := &knockrd.Config{
+		Widening: knockrd.WideningPolicies{
+			{EmailDomains: []string{"example.com"}, IPv4PrefixLength: 24, IPv6PrefixLength: 64},
+		},
+	}
+	_, auth := knockrd.NewHTTPHandlers(b, conf, "bob@example.net")
+	b.Set(knockrd.Item{Key: "2001:db8::1"})
+	for ip, code := range map[string]int{
+		"2001:db8::1": http.StatusOK,
+		"2001:db8::2": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		req.Header.Set("X-Real-IP", ip)
+		w := httptest.NewRecorder()
+		auth(w, req)
+		if w.Code != code {
+			t.Errorf("unexpected status %d for %s", w.Code, ip)
+		}
+	}
+}
+
+func TestWidenedAllowanceStream(t *testing.T) {
+	conf := &knockrd.Config{
+		TTL: time.Hour,
+		Firewall: &knockrd.FirewallConfig{
+			Type:  knockrd.FirewallTypeIPSet,
+			SetV4: "knockrd",
+			SetV6: "knockrd6",
+		},
+	}
+	var commands []string
+	handler := knockrd.NewStreamHandlerWithExecutor(conf, func(_ context.Context, stdin string, name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	})
+	var ev events.DynamoDBEvent
+	for i, key := range []string{"198.51.100.0/24", "2001:db8:1::/64", "198.51.100.1/24"} {
+		ev.Records = append(ev.Records, events.DynamoDBEventRecord{
+			EventName: "INSERT",
+			Change: events.DynamoDBStreamRecord{
+				Keys:           map[string]events.DynamoDBAttributeValue{"Key": events.NewStringAttribute(key)},
+				SequenceNumber: fmt.Sprint(i + 1),
+			},
+		})
+	}
+	if err := handler(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ipset add knockrd 198.51.100.0/24 timeout 3600 -exist",
+		"ipset add knockrd6 2001:db8:1::/64 timeout 3600 -exist",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commands %#v", commands)
+	}
+}
+
+func TestLoadConfigWidening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knockrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for yaml, valid := range map[string]bool{
+		"widening:\n  - email_domains: [example.com]\n    ipv4_prefix_length: 24\n": true,
+		"widening:\n  - identities: ['*']\n    ipv6_prefix_length: 64\n":            true,
+		"widening:\n  - ipv4_prefix_length: 24\n":                                   false,
+		"widening:\n  - identities: ['*']\n    ipv4_prefix_length: 8\n":             false,
+		"widening:\n  - identities: ['*']\n    ipv6_prefix_length: 32\n":            false,
+	} {
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := knockrd.LoadConfig(path)
+		if valid && err != nil {
+			t.Errorf("unexpected error %s for %s", err, yaml)
+		} else if !valid && err == nil {
+			t.Errorf("expected an error for %s", yaml)
+		}
+	}
+}